@@ -1,29 +1,313 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"hash/fnv"
+	"io"
 	"log"
+	"log/slog"
+	"maps"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"os/signal"
+	"runtime/debug"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
 // Task represents a ride assignment task between a rider and a driver.
 // The 'IsTerminationSignal' flag is used to indicate when a worker should stop.
+// Tasks with a higher Priority are dispatched first; equal priorities are FIFO.
 type Task struct {
+	ID                  string
 	Rider               string
+	Riders              []string // Co-riders sharing a pooled ride with Rider
 	Driver              string
+	Priority            int
+	Deadline            time.Time // Skip the task if it starts after this; zero means no expiry
+	StartAfter          time.Time // Hold the task back until this time; zero means start when a worker is free
+	RiderLat            float64
+	RiderLng            float64
+	DriverLat           float64
+	DriverLng           float64
+	DriverRating        float64           // Rating of the matched driver, if known
+	Candidates          []Driver          // Drivers to offer the ride to, in order, if Driver rejects it
+	Retries             int               // Number of times this task has been retried
+	Seq                 uint64            // Submission order within the pool, set by Submit
+	EnqueuedAt          time.Time         // When the task was first submitted, set by Submit unless already set
+	StartedAt           time.Time         // When a worker last began processing the task
+	GroupID             string            // Group the task was submitted in by SubmitGroup, if any
+	Metadata            map[string]string // Caller's context, e.g. promo code or region; copied by Submit
 	IsTerminationSignal bool
+
+	generation uint64          // CancelAll generation the task was submitted in, set by Submit
+	submitCtx  context.Context // Parent of the task's spans, set by SubmitContext
+	queuedAt   time.Time       // When the task was submitted or last requeued or, if scheduled, became due
+	stream     *taskStream     // Stream the task was submitted through, if any
 }
 
-// NewTask creates a normal ride assignment task.
+// taskSeq is the source of automatically generated task IDs.
+var taskSeq atomic.Uint64
+
+// NewTask creates a normal ride assignment task with a unique, monotonically
+// increasing ID.
 func NewTask(rider, driver string) Task {
+	return NewTaskWithID(fmt.Sprintf("task-%d", taskSeq.Add(1)), rider, driver)
+}
+
+// NewPoolTask creates a shared ride taking every one of riders with driver.
+// The first rider is the task's Rider; the rest become its Riders.
+func NewPoolTask(riders []string, driver string) Task {
+	task := NewTask("", driver)
+	if len(riders) > 0 {
+		task.Rider = riders[0]
+		task.Riders = slices.Clone(riders[1:])
+	}
+	return task
+}
+
+// NewTaskValidated creates a task like NewTask, but returns an error
+// wrapping ErrInvalidTask instead if rider or driver is empty.
+func NewTaskValidated(rider, driver string) (Task, error) {
+	if err := validateFields(Task{Rider: rider, Driver: driver}); err != nil {
+		return Task{}, err
+	}
+	return NewTask(rider, driver), nil
+}
+
+// NewTaskAt creates a task like NewTaskValidated with the rider and driver
+// at the given locations. Under CoordinatesStrict an out-of-range location
+// is an error wrapping ErrInvalidTask; under CoordinatesNormalize it is
+// brought into range with NormalizeLocation.
+func NewTaskAt(rider string, riderAt Location, driver string, driverAt Location, mode CoordinateMode) (Task, error) {
+	task, err := NewTaskValidated(rider, driver)
+	if err != nil {
+		return Task{}, err
+	}
+	task.RiderLat, task.RiderLng = riderAt.Lat, riderAt.Lng
+	task.DriverLat, task.DriverLng = driverAt.Lat, driverAt.Lng
+	if mode == CoordinatesNormalize {
+		return task.Normalized(), nil
+	}
+	if err := validateFields(task); err != nil {
+		return Task{}, err
+	}
+	return task, nil
+}
+
+// Normalized returns a copy of t with both locations brought into range by
+// NormalizeLocation.
+func (t Task) Normalized() Task {
+	rider := NormalizeLocation(Location{Lat: t.RiderLat, Lng: t.RiderLng})
+	driver := NormalizeLocation(Location{Lat: t.DriverLat, Lng: t.DriverLng})
+	t.RiderLat, t.RiderLng = rider.Lat, rider.Lng
+	t.DriverLat, t.DriverLng = driver.Lat, driver.Lng
+	return t
+}
+
+// NewTaskWithID creates a ride assignment task using a caller-supplied ID,
+// e.g. one issued by an external booking system.
+func NewTaskWithID(id, rider, driver string) Task {
 	return Task{
+		ID:                  id,
 		Rider:               rider,
 		Driver:              driver,
 		IsTerminationSignal: false,
 	}
 }
 
+// taskInput is the JSON shape of a task in an input file.
+type taskInput struct {
+	Rider  string `json:"rider"`
+	Driver string `json:"driver"`
+}
+
+// maxTaskLineBytes is the longest line StreamTasksFromReader will parse.
+const maxTaskLineBytes = 64 * 1024
+
+// StreamTasksFromReader reads newline-delimited JSON from r, one
+// {"rider": ..., "driver": ...} object per line, and passes each task to
+// submit as soon as its line arrives. Blank lines are ignored, and
+// malformed, invalid or oversized lines are logged and skipped rather than
+// ending the stream. It returns the first error from submit, or from reading r.
+func StreamTasksFromReader(r io.Reader, submit func(Task) error) error {
+	br := bufio.NewReaderSize(r, maxTaskLineBytes)
+	for line := 1; ; line++ {
+		raw, readErr := br.ReadSlice('\n')
+		if errors.Is(readErr, bufio.ErrBufferFull) {
+			slog.Warn("skipping oversized task line", "event", "bad_input", "line", line, "limit", maxTaskLineBytes)
+			for errors.Is(readErr, bufio.ErrBufferFull) {
+				_, readErr = br.ReadSlice('\n')
+			}
+			raw = nil
+		}
+		if readErr != nil && readErr != io.EOF {
+			return readErr
+		}
+		if err := submitTaskLine(line, raw, submit); err != nil {
+			return err
+		}
+		if readErr == io.EOF {
+			return nil
+		}
+	}
+}
+
+// submitTaskLine parses one line of StreamTasksFromReader input and submits
+// the task, logging and skipping the line if it is malformed or invalid.
+func submitTaskLine(line int, raw []byte, submit func(Task) error) error {
+	text := bytes.TrimSpace(raw)
+	if len(text) == 0 {
+		return nil
+	}
+
+	var in taskInput
+	if err := json.Unmarshal(text, &in); err != nil {
+		slog.Warn("skipping malformed task line", "event", "bad_input", "line", line, "error", err)
+		return nil
+	}
+	task, err := in.task()
+	if err != nil {
+		slog.Warn("skipping invalid task line", "event", "bad_input", "line", line, "error", err)
+		return nil
+	}
+	if err := submit(task); err != nil {
+		return fmt.Errorf("line %d: %w", line, err)
+	}
+	return nil
+}
+
+// Validate checks tasks without running them and returns one error per
+// invalid task, naming it by ID and position. A task is invalid if it has no
+// rider or driver, has coordinates outside the valid latitude and longitude
+// ranges, or has a deadline that has already passed. Termination signals are
+// skipped.
+func Validate(tasks []Task) []error {
+	now := time.Now()
+	var errs []error
+	for i, task := range tasks {
+		if task.IsTerminationSignal {
+			continue
+		}
+		if err := validateTask(task, now); err != nil {
+			errs = append(errs, fmt.Errorf("task %d (%s): %w", i, task.ID, err))
+		}
+	}
+	return errs
+}
+
+// ErrInvalidTask is wrapped by every error reporting a malformed task.
+var ErrInvalidTask = errors.New("invalid task")
+
+// validateTask reports the first problem with task, judging its deadline
+// against now.
+func validateTask(task Task, now time.Time) error {
+	if err := validateFields(task); err != nil {
+		return err
+	}
+	if !task.Deadline.IsZero() && !task.Deadline.After(now) {
+		return fmt.Errorf("deadline %s has passed", task.Deadline.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// validateFields reports the first malformed field of task, wrapping
+// ErrInvalidTask.
+func validateFields(task Task) error {
+	switch {
+	case task.Rider == "":
+		return fmt.Errorf("%w: missing rider", ErrInvalidTask)
+	case task.Driver == "":
+		return fmt.Errorf("%w: missing driver", ErrInvalidTask)
+	case !validLocation(Location{Lat: task.RiderLat, Lng: task.RiderLng}):
+		return fmt.Errorf("%w: rider coordinates (%g, %g) out of range", ErrInvalidTask, task.RiderLat, task.RiderLng)
+	case !validLocation(Location{Lat: task.DriverLat, Lng: task.DriverLng}):
+		return fmt.Errorf("%w: driver coordinates (%g, %g) out of range", ErrInvalidTask, task.DriverLat, task.DriverLng)
+	}
+	return nil
+}
+
+// validLocation reports whether l is a real point on the globe.
+func validLocation(l Location) bool {
+	return l.Lat >= -90 && l.Lat <= 90 && l.Lng >= -180 && l.Lng <= 180
+}
+
+// CoordinateMode decides what happens to a location outside the valid
+// latitude and longitude ranges.
+type CoordinateMode int
+
+const (
+	CoordinatesStrict    CoordinateMode = iota // Reject the task as invalid
+	CoordinatesNormalize                       // Clamp latitude and wrap longitude
+)
+
+// NormalizeLocation brings l into range: latitude is clamped to [-90, 90],
+// and longitude is wrapped around the antimeridian into [-180, 180), so 190
+// becomes -170. A NaN coordinate is left as it is and stays invalid.
+func NormalizeLocation(l Location) Location {
+	l.Lat = min(max(l.Lat, -90), 90)
+	if l.Lng < -180 || l.Lng >= 180 {
+		l.Lng = math.Mod(l.Lng+180, 360)
+		if l.Lng < 0 {
+			l.Lng += 360
+		}
+		l.Lng -= 180
+	}
+	return l
+}
+
+// LoadTasksFromJSON parses a JSON array of {"rider": ..., "driver": ...}
+// objects into tasks. Malformed JSON or a missing rider or driver is
+// reported as an error naming the offending entry.
+func LoadTasksFromJSON(r io.Reader) ([]Task, error) {
+	var inputs []taskInput
+	if err := json.NewDecoder(r).Decode(&inputs); err != nil {
+		return nil, fmt.Errorf("decoding tasks: %w", err)
+	}
+
+	tasks := make([]Task, 0, len(inputs))
+	for i, in := range inputs {
+		task, err := in.task()
+		if err != nil {
+			return nil, fmt.Errorf("task %d: %w", i, err)
+		}
+		tasks = append(tasks, task)
+	}
+	return tasks, nil
+}
+
+// task converts the input into a Task, rejecting a missing rider or driver.
+func (in taskInput) task() (Task, error) {
+	return NewTaskValidated(in.Rider, in.Driver)
+}
+
+// AllRiders returns every rider on the task: Rider followed by any co-riders.
+func (t Task) AllRiders() []string {
+	return append([]string{t.Rider}, t.Riders...)
+}
+
+// Key identifies the task for duplicate detection; by default this is the
+// rider, since one rider should never be assigned two drivers.
+func (t Task) Key() string {
+	return t.Rider
+}
+
 // TerminationSignal returns a special task that signals the worker to stop.
 func TerminationSignal() Task {
 	return Task{
@@ -31,81 +315,4473 @@ func TerminationSignal() Task {
 	}
 }
 
-// Process simulates handling a ride assignment task with a delay.
-func (t Task) Process() {
+// averageSpeedKmh is the assumed driving speed used to estimate arrival times.
+const averageSpeedKmh = 40.0
+
+// defaultSurgeThreshold and defaultMaxSurge are the surge pricing settings
+// used when a pool does not set its own.
+const (
+	defaultSurgeThreshold = 1.0
+	defaultMaxSurge       = 3.0
+)
+
+// defaultProcessDelay is the simulated work time for tasks without coordinates.
+const defaultProcessDelay = 1 * time.Second
+
+// hasCoordinates reports whether any rider or driver coordinate is set.
+func (t Task) hasCoordinates() bool {
+	return t.RiderLat != 0 || t.RiderLng != 0 || t.DriverLat != 0 || t.DriverLng != 0
+}
+
+// ETA estimates how long the driver needs to reach the rider, based on the
+// haversine distance between them and averageSpeedKmh.
+func (t Task) ETA() time.Duration {
+	km := haversineKm(Location{t.RiderLat, t.RiderLng}, Location{t.DriverLat, t.DriverLng})
+	return time.Duration(km / averageSpeedKmh * float64(time.Hour))
+}
+
+// Process simulates handling a ride assignment task with a delay equal to the
+// driver's ETA, or defaultProcessDelay when the task has no coordinates. A
+// non-nil error means the assignment could not be made and the task should be
+// retried or recorded as failed; if ctx ends during the delay, Process stops
+// early and returns its cause.
+func (t Task) Process(ctx context.Context) error {
+	return t.processWithClock(ctx, RealClock{})
+}
+
+// sleepContext waits for d on clock, returning ctx's cause as soon as ctx is
+// cancelled. Waiting on both at once, rather than sleeping in slices and
+// polling between them, means cancellation is noticed immediately instead of
+// at the next slice boundary.
+func sleepContext(ctx context.Context, clock Clock, d time.Duration) error {
+	select {
+	case <-clock.After(d):
+		return nil
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	}
+}
+
+// processWithClock is Process with the delay measured by clock.
+func (t Task) processWithClock(ctx context.Context, clock Clock) error {
+	delay := defaultProcessDelay
+	if t.hasCoordinates() {
+		delay = t.ETA()
+	}
+
 	// Simulate computational work with a delay
-	time.Sleep(1 * time.Second)
-	fmt.Printf("Assigned %s to %s\n", t.Driver, t.Rider)
+	if err := sleepContext(ctx, clock, delay); err != nil {
+		return err
+	}
+
+	fmt.Printf("Assigned %s to %s\n", t.Driver, strings.Join(t.AllRiders(), ", "))
+	return nil
 }
 
-// worker is a goroutine that retrieves tasks from the channel and processes them.
-// It writes results to the shared slice safely using a mutex.
-func worker(id int, tasks <-chan Task, results *[]string, wg *sync.WaitGroup, mu *sync.Mutex) {
-	defer wg.Done() // Decrement the WaitGroup counter when the worker exits
+// Clock is the source of time for the pool and the simulated processor, so
+// tests can replace real sleeps with a FakeClock.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	Sleep(d time.Duration)
+}
 
-	for {
-		task, ok := <-tasks // Receive task from the channel
-		if !ok {
-			log.Printf("Worker %d: task channel closed\n", id)
-			return
+// RealClock is a Clock backed by the time package.
+type RealClock struct{}
+
+func (RealClock) Now() time.Time                         { return time.Now() }
+func (RealClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (RealClock) Sleep(d time.Duration)                  { time.Sleep(d) }
+
+// FakeClock is a Clock whose time only moves when Advance is called. It is
+// safe for concurrent use.
+type FakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []fakeWaiter
+}
+
+// fakeWaiter is a pending After call on a FakeClock.
+type fakeWaiter struct {
+	at time.Time
+	ch chan time.Time
+}
+
+// NewFakeClock creates a FakeClock reading start.
+func NewFakeClock(start time.Time) *FakeClock {
+	return &FakeClock{now: start}
+}
+
+// Now returns the fake current time.
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// After returns a channel that receives the fake time once the clock has
+// been advanced by at least d.
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.waiters = append(c.waiters, fakeWaiter{at: c.now.Add(d), ch: ch})
+	return ch
+}
+
+// Sleep blocks until the clock has been advanced by at least d.
+func (c *FakeClock) Sleep(d time.Duration) {
+	<-c.After(d)
+}
+
+// Advance moves the clock forward by d and fires every After that is now due.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+	pending := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.at.After(c.now) {
+			pending = append(pending, w)
+			continue
 		}
+		w.ch <- c.now
+	}
+	c.waiters = pending
+}
 
-		// Stop processing if the termination signal is received
-		if task.IsTerminationSignal {
-			log.Printf("Worker %d: received termination signal\n", id)
-			return
+// Waiters returns how many After calls are still waiting, so a test can tell
+// when the code under test has started sleeping.
+func (c *FakeClock) Waiters() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.waiters)
+}
+
+// Location is a point on the map in degrees.
+type Location struct {
+	Lat float64
+	Lng float64
+}
+
+// Rider is a customer waiting to be picked up.
+type Rider struct {
+	Name     string
+	Location Location
+}
+
+// Driver is a driver available to take a ride. Weight biases weighted
+// strategies towards this driver (e.g. for vehicle capacity); a weight below
+// one counts as one. Rating is the driver's quality score, such as an
+// average of one to five stars, used by HighestRatedStrategy.
+type Driver struct {
+	Name     string
+	Location Location
+	Weight   int
+	Rating   float64
+}
+
+// earthRadiusKm is the mean radius of the Earth.
+const earthRadiusKm = 6371.0
+
+// haversineKm returns the great-circle distance between two locations in kilometres.
+func haversineKm(a, b Location) float64 {
+	toRad := func(deg float64) float64 { return deg * math.Pi / 180 }
+	dLat := toRad(b.Lat - a.Lat)
+	dLng := toRad(b.Lng - a.Lng)
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(toRad(a.Lat))*math.Cos(toRad(b.Lat))*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadiusKm * math.Asin(math.Sqrt(h))
+}
+
+// Strategy decides which of the available drivers a rider is matched with.
+// drivers is never empty; ok is false if none of them is acceptable.
+type Strategy interface {
+	Select(rider Rider, drivers []Driver) (driver Driver, ok bool)
+}
+
+// NearestStrategy picks the driver closest to the rider.
+type NearestStrategy struct{}
+
+// Select returns the driver with the shortest haversine distance to rider.
+func (NearestStrategy) Select(rider Rider, drivers []Driver) (Driver, bool) {
+	nearest := drivers[0]
+	for _, d := range drivers[1:] {
+		if haversineKm(rider.Location, d.Location) < haversineKm(rider.Location, nearest.Location) {
+			nearest = d
+		}
+	}
+	return nearest, true
+}
+
+// HighestRatedStrategy picks the driver with the highest Rating. When
+// several share the top rating, TieBreak chooses among them; a nil TieBreak
+// means NearestStrategy.
+type HighestRatedStrategy struct {
+	TieBreak Strategy
+}
+
+// Select returns the highest-rated driver, breaking ties with TieBreak.
+func (s HighestRatedStrategy) Select(rider Rider, drivers []Driver) (Driver, bool) {
+	var top []Driver
+	for _, d := range drivers {
+		switch {
+		case len(top) == 0 || d.Rating > top[0].Rating:
+			top = append(top[:0], d)
+		case d.Rating == top[0].Rating:
+			top = append(top, d)
+		}
+	}
+
+	tieBreak := s.TieBreak
+	if tieBreak == nil {
+		tieBreak = NearestStrategy{}
+	}
+	return tieBreak.Select(rider, top)
+}
+
+// RoundRobinStrategy hands riders to the available drivers in turn, by
+// position in the list it is given, regardless of distance. It is safe for
+// concurrent use.
+type RoundRobinStrategy struct {
+	mu   sync.Mutex
+	next int
+}
+
+// Select returns the driver whose turn it is.
+func (s *RoundRobinStrategy) Select(_ Rider, drivers []Driver) (Driver, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d := drivers[s.next%len(drivers)]
+	s.next++
+	return d, true
+}
+
+// RandomStrategy picks an available driver uniformly at random, as a
+// baseline for comparing other strategies. It is safe for concurrent use.
+type RandomStrategy struct {
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+// NewRandomStrategy creates a random strategy. A fixed seed gives the same
+// sequence of picks on every run; zero seeds it randomly.
+func NewRandomStrategy(seed uint64) *RandomStrategy {
+	if seed == 0 {
+		seed = rand.Uint64()
+	}
+	return &RandomStrategy{rng: rand.New(rand.NewPCG(seed, seed))}
+}
+
+// Select returns a random driver.
+func (s *RandomStrategy) Select(_ Rider, drivers []Driver) (Driver, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return drivers[s.rng.IntN(len(drivers))], true
+}
+
+// WeightedRoundRobinStrategy spreads riders across drivers in proportion to
+// their weights using smooth weighted round-robin, so a driver with weight 3
+// is picked three times as often as one with weight 1 while they are both
+// available. It is safe for concurrent use.
+type WeightedRoundRobinStrategy struct {
+	mu      sync.Mutex
+	current map[string]int // Running score per driver name
+}
+
+// NewWeightedRoundRobinStrategy creates a weighted round-robin strategy.
+func NewWeightedRoundRobinStrategy() *WeightedRoundRobinStrategy {
+	return &WeightedRoundRobinStrategy{current: make(map[string]int)}
+}
+
+// Select raises every driver's score by its weight, picks the highest score,
+// and lowers the winner's score by the total weight.
+func (s *WeightedRoundRobinStrategy) Select(_ Rider, drivers []Driver) (Driver, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	total := 0
+	best := 0
+	for i, d := range drivers {
+		w := max(d.Weight, 1)
+		total += w
+		s.current[d.Name] += w
+		if s.current[d.Name] > s.current[drivers[best].Name] {
+			best = i
+		}
+	}
+	s.current[drivers[best].Name] -= total
+	return drivers[best], true
+}
+
+// Matcher pairs waiting riders with available drivers. Riders are served in
+// the order they arrived, each taking the driver chosen by the matcher's
+// strategy from those still available.
+type Matcher struct {
+	// PoolCapacity is how many riders one driver may take on a shared ride;
+	// zero or one disables pooling. Waiting riders within PoolRadiusKm of a
+	// matched rider join that rider's ride, in arrival order, until it is
+	// full. A zero PoolRadiusKm means defaultPoolRadiusKm.
+	PoolCapacity int
+	PoolRadiusKm float64
+
+	mu       sync.Mutex
+	strategy Strategy
+	riders   []Rider
+	drivers  []Driver
+}
+
+// defaultPoolRadiusKm is how close riders must be to share a ride when a
+// Matcher does not set PoolRadiusKm.
+const defaultPoolRadiusKm = 1.0
+
+// NewMatcher creates an empty matcher that picks the nearest driver.
+func NewMatcher() *Matcher {
+	return NewMatcherWithStrategy(NearestStrategy{})
+}
+
+// NewMatcherWithStrategy creates an empty matcher that picks drivers with s.
+func NewMatcherWithStrategy(s Strategy) *Matcher {
+	return &Matcher{strategy: s}
+}
+
+// AddRider queues a rider waiting for a driver.
+func (m *Matcher) AddRider(r Rider) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.riders = append(m.riders, r)
+}
+
+// AddDriver makes a driver available for matching.
+func (m *Matcher) AddDriver(d Driver) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.drivers = append(m.drivers, d)
+}
+
+// Match pairs as many waiting riders as possible with an available driver
+// and returns one task per pair. Matched riders and drivers are removed;
+// anyone left over, including a rider the strategy found no driver for,
+// waits for the next call.
+func (m *Matcher) Match() []Task {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var tasks []Task
+	var unmatched []Rider
+	for len(m.riders) > 0 && len(m.drivers) > 0 {
+		rider := m.riders[0]
+		m.riders = m.riders[1:]
+
+		driver, ok := m.strategy.Select(rider, m.drivers)
+		i := slices.Index(m.drivers, driver)
+		if !ok || i < 0 {
+			unmatched = append(unmatched, rider)
+			continue
+		}
+		m.drivers = slices.Delete(m.drivers, i, i+1)
+
+		task := NewTask(rider.Name, driver.Name)
+		task.Riders = m.poolWith(rider)
+		task.RiderLat, task.RiderLng = rider.Location.Lat, rider.Location.Lng
+		task.DriverLat, task.DriverLng = driver.Location.Lat, driver.Location.Lng
+		task.DriverRating = driver.Rating
+		tasks = append(tasks, task)
+	}
+	m.riders = append(unmatched, m.riders...)
+	return tasks
+}
+
+// poolWith removes and returns the names of waiting riders close enough to
+// share first's ride, up to PoolCapacity in total. The caller holds m.mu.
+func (m *Matcher) poolWith(first Rider) []string {
+	radius := m.PoolRadiusKm
+	if radius <= 0 {
+		radius = defaultPoolRadiusKm
+	}
+
+	var pooled []string
+	for i := 0; i < len(m.riders) && len(pooled)+1 < m.PoolCapacity; {
+		if haversineKm(first.Location, m.riders[i].Location) > radius {
+			i++
+			continue
+		}
+		pooled = append(pooled, m.riders[i].Name)
+		m.riders = slices.Delete(m.riders, i, i+1)
+	}
+	return pooled
+}
+
+// queuedTask pairs a task with its insertion order so that tasks of equal
+// priority keep first-in, first-out ordering.
+type queuedTask struct {
+	task  Task
+	seq   uint64
+	score float64 // Priority less AgingRate times the seconds from queue epoch to queuedAt
+}
+
+// taskHeap implements heap.Interface, ordering by descending effective
+// priority. A task's effective priority is its Priority plus AgingRate for
+// every second it has waited. Both tasks age at the same rate, so comparing
+// Priority - AgingRate*enqueueTime ranks them identically at any moment;
+// that is the score, fixed at enqueue, which keeps the heap valid as time
+// passes.
+type taskHeap []queuedTask
+
+func (h taskHeap) Len() int { return len(h) }
+
+func (h taskHeap) Less(i, j int) bool {
+	if h[i].score != h[j].score {
+		return h[i].score > h[j].score
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h taskHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *taskHeap) Push(x any) { *h = append(*h, x.(queuedTask)) }
+
+func (h *taskHeap) Pop() any {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	*h = old[:n-1]
+	return item
+}
+
+// delayHeap orders scheduled tasks by when they become due.
+type delayHeap struct{ taskHeap }
+
+func (h delayHeap) Less(i, j int) bool {
+	if !h.taskHeap[i].task.StartAfter.Equal(h.taskHeap[j].task.StartAfter) {
+		return h.taskHeap[i].task.StartAfter.Before(h.taskHeap[j].task.StartAfter)
+	}
+	return h.taskHeap[i].seq < h.taskHeap[j].seq
+}
+
+// taskQueue is a bounded priority queue shared by all workers. Tasks with a
+// future StartAfter wait in a delay heap, still counting towards capacity,
+// and join the priority queue once due. With RetryQueueSize set, retries
+// wait in a bounded lane of their own, outside capacity, served only when no
+// fresh task is due. Termination signals wait in a separate lane that is
+// only served once no tasks are queued or scheduled, so a worker never stops
+// while work it could pick up remains, whatever order tasks and signals
+// were submitted in.
+type taskQueue struct {
+	mu       sync.Mutex
+	notEmpty *sync.Cond // Signalled when a task is pushed or the queue closes
+	notFull  *sync.Cond // Signalled when a task is popped or the queue closes
+	items    taskHeap
+	delayed  delayHeap  // Tasks whose StartAfter has not yet arrived
+	retries  []Task     // Retried tasks, oldest first, when the retry lane is on
+	retryCap func() int // RetryQueueSize; zero sends retries back into items
+	wakeAt   time.Time  // When a pending timer will next promote delayed tasks
+	clock    func() Clock
+	aging    func() float64 // AgingRate, in priority points per second waited
+	epoch    time.Time      // Time of the first enqueue; scores count from here
+	capacity int
+	seq      uint64
+	held     int // Popped tasks not yet marked done; they may still be requeued
+	quits    int // Pending termination signals
+	paused   bool
+	closed   bool
+}
+
+// newTaskQueue creates a queue holding at most capacity tasks (minimum one).
+func newTaskQueue(capacity int) *taskQueue {
+	if capacity < 1 {
+		capacity = 1
+	}
+	q := &taskQueue{
+		capacity: capacity,
+		clock:    func() Clock { return RealClock{} },
+		aging:    func() float64 { return 0 },
+		retryCap: func() int { return 0 },
+	}
+	q.notEmpty = sync.NewCond(&q.mu)
+	q.notFull = sync.NewCond(&q.mu)
+	return q
+}
+
+// wakeOnDone wakes every waiter when ctx is cancelled so they can re-check it.
+// The returned function must be called to release the registration.
+func (q *taskQueue) wakeOnDone(ctx context.Context) func() bool {
+	return context.AfterFunc(ctx, func() {
+		q.mu.Lock()
+		q.notEmpty.Broadcast()
+		q.notFull.Broadcast()
+		q.mu.Unlock()
+	})
+}
+
+// push adds a task, handling a full queue according to policy: it blocks
+// for room, adds the task past capacity, or returns ErrBufferFull straight
+// away. Termination signals do not take up capacity and never wait. It
+// returns ErrPoolClosed if the queue was closed, or ctx's cause if ctx was
+// cancelled, before the task could be added.
+func (q *taskQueue) push(ctx context.Context, task Task, policy QueuePolicy) error {
+	stop := q.wakeOnDone(ctx)
+	defer stop()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	quit := task.IsTerminationSignal
+	for policy == QueueBlock && !quit && q.size() >= q.capacity && !q.closed && ctx.Err() == nil {
+		q.notFull.Wait()
+	}
+	switch {
+	case q.closed:
+		return ErrPoolClosed
+	case ctx.Err() != nil:
+		return context.Cause(ctx)
+	case quit:
+		q.quits++
+		q.notEmpty.Signal()
+		return nil
+	case policy != QueueGrow && q.size() >= q.capacity:
+		return ErrBufferFull
+	}
+
+	q.add(task)
+	return nil
+}
+
+// add queues task, or schedules it if it is not yet due, stamping when its
+// wait starts unless Submit already has. The caller holds q.mu.
+func (q *taskQueue) add(task Task) {
+	now := q.clock().Now()
+	if q.epoch.IsZero() {
+		q.epoch = now
+	}
+	q.seq++
+	if task.queuedAt.IsZero() {
+		task.queuedAt = queueStart(task, now)
+	}
+	item := queuedTask{
+		task:  task,
+		seq:   q.seq,
+		score: float64(task.Priority) - q.aging()*task.queuedAt.Sub(q.epoch).Seconds(),
+	}
+	if task.StartAfter.After(now) {
+		heap.Push(&q.delayed, item)
+		q.notEmpty.Broadcast() // Poppers may need an earlier wake-up
+		return
+	}
+	heap.Push(&q.items, item)
+	q.notEmpty.Signal()
+}
+
+// queueStart returns when task, joining the queue at now, starts waiting:
+// straight away, or once its StartAfter arrives, since waiting for its start
+// time is not queueing.
+func queueStart(task Task, now time.Time) time.Time {
+	if task.StartAfter.After(now) {
+		return task.StartAfter
+	}
+	return now
+}
+
+// size returns how many tasks are queued or scheduled. The caller holds q.mu.
+func (q *taskQueue) size() int {
+	return len(q.items) + len(q.delayed.taskHeap)
+}
+
+// promote moves every scheduled task that is now due into the priority
+// queue, and otherwise makes sure a timer will wake the poppers when the
+// next one, or the next retry backing off, is due. The caller holds q.mu.
+func (q *taskQueue) promote() {
+	clock := q.clock()
+	now := clock.Now()
+	for len(q.delayed.taskHeap) > 0 && !q.delayed.taskHeap[0].task.StartAfter.After(now) {
+		heap.Push(&q.items, heap.Pop(&q.delayed).(queuedTask))
+	}
+
+	var due time.Time
+	if len(q.delayed.taskHeap) > 0 {
+		due = q.delayed.taskHeap[0].task.StartAfter
+	}
+	for _, task := range q.retries {
+		if task.StartAfter.After(now) && (due.IsZero() || task.StartAfter.Before(due)) {
+			due = task.StartAfter // A retry still backing off
+		}
+	}
+	if due.IsZero() {
+		return
+	}
+	if !q.wakeAt.IsZero() && !due.Before(q.wakeAt) {
+		return // An early enough wake-up is already pending
+	}
+	q.wakeAt = due
+	go func() {
+		<-clock.After(due.Sub(now))
+		q.mu.Lock()
+		if q.wakeAt.Equal(due) {
+			q.wakeAt = time.Time{}
 		}
+		q.notEmpty.Broadcast()
+		q.mu.Unlock()
+	}()
+}
 
-		log.Printf("Worker %d: processing task for %s and %s\n", id, task.Rider, task.Driver)
+// pop removes the highest-priority due task, blocking while there is none
+// or the queue is paused. The oldest retry whose backoff is over is handed
+// out only when no fresh task is due, and a pending termination signal only
+// when no task is queued, scheduled or waiting to be retried. Every successful pop must be
+// paired with a call to done. It returns false once the queue is closed,
+// drained and no popped task is still being handled (and so might be
+// requeued), or when ctx is cancelled.
+func (q *taskQueue) pop(ctx context.Context) (Task, bool) {
+	stop := q.wakeOnDone(ctx)
+	defer stop()
 
-		// Handle panic safely with defer and recover
-		func() {
-			defer func() {
-				if r := recover(); r != nil {
-					log.Printf("Worker %d: error processing task: %v\n", id, r)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for ctx.Err() == nil {
+		q.promote()
+		if !q.paused {
+			if len(q.items) > 0 {
+				item := heap.Pop(&q.items).(queuedTask)
+				q.held++
+				q.notFull.Signal()
+				return item.task, true
+			}
+			now := q.clock().Now()
+			if i := slices.IndexFunc(q.retries, func(t Task) bool { return !t.StartAfter.After(now) }); i >= 0 {
+				task := q.retries[i]
+				q.retries = slices.Delete(q.retries, i, i+1)
+				q.held++
+				return task, true
+			}
+			if len(q.delayed.taskHeap) == 0 && len(q.retries) == 0 {
+				if q.quits > 0 {
+					q.quits--
+					q.held++
+					return TerminationSignal(), true
 				}
-			}()
-			task.Process()
-		}()
+				if q.closed && q.held == 0 {
+					return Task{}, false
+				}
+			}
+		}
+		q.notEmpty.Wait()
+	}
+	return Task{}, false
+}
 
-		// Use mutex to safely append to shared results slice
-		mu.Lock()
-		*results = append(*results, fmt.Sprintf("Assigned %s to %s", task.Driver, task.Rider))
-		mu.Unlock()
+// done marks a popped task as fully handled.
+func (q *taskQueue) done() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.held--
+	if q.held == 0 && q.closed {
+		q.notEmpty.Broadcast() // Let idle poppers see the queue is finished
+	}
+}
 
-		log.Printf("Worker %d: finished task\n", id)
+// requeue puts a retried task back on the queue. Unlike push it ignores the
+// capacity limit and the closed flag, so a worker retrying a task can never
+// deadlock against a full queue or lose the task during Wait.
+func (q *taskQueue) requeue(task Task) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if task.IsTerminationSignal {
+		q.quits++
+		q.notEmpty.Signal()
+		return
 	}
+	task.queuedAt = time.Time{} // Its wait starts over
+	q.add(task)
 }
 
-func main() {
-	numWorkers := 4                         // Number of concurrent workers
-	tasks := make(chan Task, 20)           // Buffered channel to hold tasks
-	var results []string                   // Shared slice to store results
-	var mu sync.Mutex                      // Mutex to guard shared results
-	var wg sync.WaitGroup                  // WaitGroup to wait for all workers
+// retry queues a retried task. With a retry lane it joins the tail of that
+// lane, and if the lane is then over capacity the oldest retry is removed
+// and returned so the caller can record it; otherwise retry is requeue.
+func (q *taskQueue) retry(task Task) (dropped Task, ok bool) {
+	limit := q.retryCap()
+	if limit <= 0 {
+		q.requeue(task)
+		return Task{}, false
+	}
 
-	// Start worker goroutines
-	for i := 1; i <= numWorkers; i++ {
-		wg.Add(1)
-		go worker(i, tasks, &results, &wg, &mu)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	task.queuedAt = queueStart(task, q.clock().Now())
+	q.retries = append(q.retries, task)
+	q.notEmpty.Signal()
+	if len(q.retries) <= limit {
+		return Task{}, false
 	}
+	dropped = q.retries[0]
+	q.retries = slices.Delete(q.retries, 0, 1)
+	return dropped, true
+}
 
-	// Create and send ride tasks to the task channel
-	for i := 1; i <= 10; i++ {
-		tasks <- NewTask(fmt.Sprintf("Rider%d", i), fmt.Sprintf("Driver%d", i))
+// remove takes the task with the given ID out of the queue, if present.
+func (q *taskQueue) remove(id string) (Task, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, item := range q.items {
+		if item.task.ID == id {
+			heap.Remove(&q.items, i)
+			q.notFull.Signal()
+			return item.task, true
+		}
+	}
+	for i, item := range q.delayed.taskHeap {
+		if item.task.ID == id {
+			heap.Remove(&q.delayed, i)
+			q.notFull.Signal()
+			return item.task, true
+		}
+	}
+	for i, task := range q.retries {
+		if task.ID == id {
+			q.retries = slices.Delete(q.retries, i, i+1)
+			return task, true
+		}
 	}
+	return Task{}, false
+}
 
-	// Send a termination signal for each worker
-	for i := 0; i < numWorkers; i++ {
-		tasks <- TerminationSignal()
+// clear removes and returns every waiting task, including those scheduled
+// for later, in no particular order. Termination signals stay queued.
+func (q *taskQueue) clear() []Task {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	tasks := make([]Task, 0, q.size()+len(q.retries))
+	for _, item := range q.items {
+		tasks = append(tasks, item.task)
+	}
+	for _, item := range q.delayed.taskHeap {
+		tasks = append(tasks, item.task)
 	}
+	tasks = append(tasks, q.retries...)
+	q.items, q.delayed.taskHeap, q.retries = nil, nil, nil
+	q.notFull.Broadcast()
+	return tasks
+}
+
+// len returns how many tasks are waiting to be picked up, including those
+// scheduled for later and retries.
+func (q *taskQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.size() + len(q.retries)
+}
 
-	close(tasks)   // No more tasks will be added
-	wg.Wait()      // Wait for all workers to complete
+// setPaused pauses or resumes pop.
+func (q *taskQueue) setPaused(paused bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.paused = paused
+	if !paused {
+		q.notEmpty.Broadcast()
+	}
+}
 
-	// Print final assignment results
-	fmt.Println("\nAll Assignments:")
-	for _, r := range results {
-		fmt.Println(r)
+// full reports whether the queue holds as many ready tasks as it has room for.
+func (q *taskQueue) full() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.items) >= q.capacity
+}
+
+// idle reports whether no task is queued, scheduled, waiting to be retried
+// or still held by a worker.
+func (q *taskQueue) idle() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.size() == 0 && len(q.retries) == 0 && q.held == 0
+}
+
+// isClosed reports whether close has been called.
+func (q *taskQueue) isClosed() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.closed
+}
+
+// close stops the queue from accepting tasks; queued tasks can still be popped.
+func (q *taskQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.notEmpty.Broadcast()
+	q.notFull.Broadcast()
+	q.mu.Unlock()
+}
+
+// Queue is a backend holding submitted tasks until the pool is ready for
+// them, so pending work can live somewhere other than memory, such as Redis
+// or a file. The pool pulls tasks from it into its own scheduling buffer,
+// which keeps priority, StartAfter, retry and termination handling at the
+// pool level; a backend only has to store tasks in order. Implementations
+// must be safe for concurrent use.
+type Queue interface {
+	// Enqueue adds task, blocking while the backend is full until ctx ends,
+	// and then returning ctx's cause. Given a ctx that has already ended it
+	// must not block: TrySubmit relies on it adding task only if there is
+	// room straight away. It returns ErrPoolClosed after Close.
+	Enqueue(ctx context.Context, task Task) error
+	// Dequeue removes the next task, blocking until one is available. It
+	// returns false once the backend is closed and empty, or when ctx ends.
+	Dequeue(ctx context.Context) (Task, bool)
+	// Len returns how many tasks are waiting.
+	Len() int
+	// Close stops Enqueue from accepting tasks; waiting ones can still be
+	// dequeued.
+	Close() error
+}
+
+// ChannelQueue is an in-memory Queue backed by a buffered channel.
+type ChannelQueue struct {
+	mu     sync.RWMutex // Held for reading by Enqueue so Close can wait it out
+	closed bool
+	tasks  chan Task
+	done   chan struct{} // Closed by Close
+}
+
+// NewChannelQueue creates a ChannelQueue holding up to capacity tasks
+// (minimum one).
+func NewChannelQueue(capacity int) *ChannelQueue {
+	return &ChannelQueue{tasks: make(chan Task, max(capacity, 1)), done: make(chan struct{})}
+}
+
+// Enqueue implements Queue.
+func (q *ChannelQueue) Enqueue(ctx context.Context, task Task) error {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed {
+		return ErrPoolClosed
+	}
+	select {
+	case q.tasks <- task: // Tried first, as select picks at random when ctx has ended too
+		return nil
+	default:
+	}
+	select {
+	case q.tasks <- task:
+		return nil
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	}
+}
+
+// Dequeue implements Queue.
+func (q *ChannelQueue) Dequeue(ctx context.Context) (Task, bool) {
+	select {
+	case task := <-q.tasks:
+		return task, true
+	case <-ctx.Done():
+		return Task{}, false
+	case <-q.done:
+		// Close waited for every Enqueue, so whatever is left is all there is
+		select {
+		case task := <-q.tasks:
+			return task, true
+		default:
+			return Task{}, false
+		}
+	}
+}
+
+// Len implements Queue.
+func (q *ChannelQueue) Len() int {
+	return len(q.tasks)
+}
+
+// Close implements Queue. It waits for blocked Enqueue calls to finish, which
+// they do once a consumer makes room or their context ends.
+func (q *ChannelQueue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.closed {
+		q.closed = true
+		close(q.done)
+	}
+	return nil
+}
+
+// TaskProcessor performs the assignment work for a task. The pool runs it
+// on a worker, fills in the bookkeeping fields of the returned Result
+// (task ID, sequence, worker ID and timing) and treats a non-nil error as a
+// failed attempt. ctx is cancelled when the pool's parent context is,
+// when the task is cancelled, or at the task's Deadline; long-running
+// implementations should watch it. logger is the pool's logger already
+// carrying the worker and task attributes, so the processor's own records
+// correlate with the pool's. Implementations must be safe for concurrent
+// use.
+type TaskProcessor interface {
+	Process(ctx context.Context, logger *slog.Logger, task Task) (Result, error)
+}
+
+// SleepProcessor is the default TaskProcessor: it runs the simulated
+// Task.Process assignment, timing the delay with Clock (RealClock if nil).
+type SleepProcessor struct {
+	Clock Clock
+}
+
+// Process runs task.Process and reports the assignment.
+func (s SleepProcessor) Process(ctx context.Context, logger *slog.Logger, task Task) (Result, error) {
+	clock := s.Clock
+	if clock == nil {
+		clock = RealClock{}
+	}
+	logger.Debug("simulating assignment", "event", "simulate", "eta", task.ETA())
+	if err := task.processWithClock(ctx, clock); err != nil {
+		return Result{}, err
+	}
+	return Result{Rider: task.Rider, Riders: slices.Clone(task.Riders), Driver: task.Driver, ETA: task.ETA()}, nil
+}
+
+// Tracer starts tracing spans. It mirrors the shape of an OpenTelemetry
+// tracer so one can be adapted with a few lines, without the pool depending
+// on a tracing library.
+type Tracer interface {
+	// Start begins a span named name as a child of the span in ctx, if any,
+	// and returns a context carrying the new span.
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is one traced operation started by a Tracer.
+type Span interface {
+	SetAttributes(attrs ...slog.Attr)
+	RecordError(err error)
+	SetStatus(code SpanStatus, description string)
+	End()
+}
+
+// SpanStatus is the outcome recorded on a span, as OpenTelemetry's status codes.
+type SpanStatus int
+
+const (
+	SpanUnset SpanStatus = iota // Neither success nor failure, e.g. a cancelled task
+	SpanOK
+	SpanError
+)
+
+// taskSpan is the span of a task attempt in progress and the error, if any,
+// that the attempt ended with.
+type taskSpan struct {
+	span Span
+	err  error
+}
+
+// valuesContext takes its deadline and cancellation from the embedded
+// context but looks values up in values first, so a task's span reaches
+// Process while the pool still decides when the task is cancelled.
+type valuesContext struct {
+	context.Context
+	values context.Context
+}
+
+func (c valuesContext) Value(key any) any {
+	if v := c.values.Value(key); v != nil {
+		return v
+	}
+	return c.Context.Value(key)
+}
+
+// Acceptor is the second phase of a two-phase assignment: once Process has
+// proposed an assignment, the pool asks the driver to confirm it. Accept
+// reports whether the driver accepted; ctx ends when AcceptTimeout passes,
+// which counts as a rejection whatever Accept later returns.
+type Acceptor interface {
+	Accept(ctx context.Context, proposal Result) bool
+}
+
+// Result records a completed ride assignment.
+type Result struct {
+	TaskID    string
+	Seq       uint64 // Submission order of the originating task
+	Rider     string
+	Riders    []string // Co-riders on a pooled ride
+	Driver    string
+	Rating    float64 // Rating of the driver, copied from Task.DriverRating
+	WorkerID  int
+	StartedAt time.Time
+	Wait      time.Duration // From submission until the successful attempt started
+	Duration  time.Duration
+	ETA       time.Duration     // Estimated driver arrival time for the task
+	Surge     float64           // Surge multiplier in effect when the task was assigned
+	Metadata  map[string]string // A copy of Task.Metadata
+}
+
+// String formats the result as the classic "Assigned <driver> to <rider>" line.
+func (r Result) String() string {
+	return fmt.Sprintf("Assigned %s to %s", r.Driver, strings.Join(append([]string{r.Rider}, r.Riders...), ", "))
+}
+
+// ErrAssignmentRejected is recorded for a task whose driver, and every one
+// of its Candidates, rejected the assignment or did not confirm it in time.
+var ErrAssignmentRejected = errors.New("assignment rejected by every driver")
+
+// ErrCircuitOpen is recorded for tasks short-circuited by an open driver breaker.
+var ErrCircuitOpen = errors.New("driver circuit breaker open")
+
+// ErrDuplicateTask is returned by Submit when Dedupe is set and a task with
+// the same key was already submitted.
+var ErrDuplicateTask = errors.New("duplicate task")
+
+// ErrPoolBusy is returned by Reset while tasks are queued or in flight.
+var ErrPoolBusy = errors.New("pool has tasks queued or in flight")
+
+// ErrPoolClosed is returned by Submit once the pool has been shut down.
+var ErrPoolClosed = errors.New("pool closed")
+
+// ErrBufferFull is returned by Submit under QueueReject when the queue is at
+// capacity.
+var ErrBufferFull = errors.New("task buffer full")
+
+// QueuePolicy decides what Submit does when the task buffer is full.
+type QueuePolicy int
+
+const (
+	QueueBlock  QueuePolicy = iota // Wait for room
+	QueueGrow                      // Grow the buffer past its capacity
+	QueueReject                    // Fail at once with ErrBufferFull
+)
+
+// ErrPoolShutdown is the cancellation cause used by Shutdown(false).
+var ErrPoolShutdown = errors.New("pool shut down")
+
+// ErrWaitTimeout is returned by WaitTimeout when workers are still running.
+var ErrWaitTimeout = errors.New("timed out waiting for workers")
+
+// ErrRetryDropped is recorded for a retry pushed out of a full retry queue;
+// see RetryQueueSize.
+var ErrRetryDropped = errors.New("retry queue full, retry dropped")
+
+// ErrTaskCancelled is the cause attached to tasks stopped by CancelTask.
+var ErrTaskCancelled = errors.New("task cancelled")
+
+// ErrTaskTimeout is recorded when a task's Process call exceeds the pool's TaskTimeout.
+var ErrTaskTimeout = errors.New("task timed out")
+
+// DriverBusyError reports that a task's driver is already on another assignment.
+type DriverBusyError struct {
+	Driver string
+}
+
+func (e *DriverBusyError) Error() string {
+	return fmt.Sprintf("driver %s is already assigned", e.Driver)
+}
+
+// DriverRegistry tracks which drivers have an assignment in progress. Pools
+// that share a registry never hand the same driver two tasks at once, even
+// when those tasks run in different pools.
+type DriverRegistry struct {
+	mu   sync.Mutex
+	busy map[string]struct{}
+}
+
+// NewDriverRegistry creates an empty registry.
+func NewDriverRegistry() *DriverRegistry {
+	return &DriverRegistry{busy: make(map[string]struct{})}
+}
+
+// Acquire marks driver as busy, returning a DriverBusyError if it already is.
+func (r *DriverRegistry) Acquire(driver string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, busy := r.busy[driver]; busy {
+		return &DriverBusyError{Driver: driver}
+	}
+	r.busy[driver] = struct{}{}
+	return nil
+}
+
+// Release frees a driver previously taken with Acquire.
+func (r *DriverRegistry) Release(driver string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.busy, driver)
+}
+
+// Busy reports whether driver currently has an assignment in progress.
+func (r *DriverRegistry) Busy(driver string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, busy := r.busy[driver]
+	return busy
+}
+
+// panicError carries a recovered panic out of Process along with its stack.
+type panicError struct {
+	value any
+	stack string
+}
+
+func (e *panicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.value)
+}
+
+// FatalError marks an error from a TaskProcessor as non-recoverable: rather
+// than failing just the one task, it stops the whole pool, and Wait returns
+// it. Wrap an error with Fatal to create one.
+type FatalError struct {
+	Err error
+}
+
+func (e *FatalError) Error() string {
+	return fmt.Sprintf("fatal: %v", e.Err)
+}
+
+func (e *FatalError) Unwrap() error {
+	return e.Err
+}
+
+// Fatal wraps err in a FatalError.
+func Fatal(err error) error {
+	return &FatalError{Err: err}
+}
+
+// PanicRecord captures a panic recovered from a task's Process call.
+type PanicRecord struct {
+	TaskID   string
+	Value    any
+	Stack    string
+	WorkerID int
+}
+
+// PanicPolicy decides what happens when a task's Process call panics.
+type PanicPolicy int
+
+const (
+	PanicRecover   PanicPolicy = iota // Record the panic as a task failure and carry on
+	PanicPropagate                    // Log the panic, then re-panic and crash the program
+)
+
+// BreakerState is the state of a driver's circuit breaker.
+type BreakerState int
+
+const (
+	BreakerClosed   BreakerState = iota // Tasks flow normally
+	BreakerOpen                         // Tasks are short-circuited until the cooldown ends
+	BreakerHalfOpen                     // One trial task decides whether to close again
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return fmt.Sprintf("BreakerState(%d)", int(s))
+	}
+}
+
+// circuitBreaker tracks consecutive failures for one driver.
+type circuitBreaker struct {
+	state    BreakerState
+	failures int       // Consecutive failures while closed
+	openedAt time.Time // When the breaker last tripped
+	trial    bool      // A half-open trial task is in progress
+}
+
+// TaskError is delivered on the Errors channel for each failed task.
+type TaskError struct {
+	Task Task
+	Err  error
+}
+
+// EventType names something that happened in the pool.
+type EventType string
+
+const (
+	EventSubmit   EventType = "submit"   // A task was accepted by Submit
+	EventDrop     EventType = "drop"     // A submitted task could not be queued after all
+	EventStart    EventType = "start"    // A worker started processing a task
+	EventComplete EventType = "complete" // A task was assigned successfully
+	EventFail     EventType = "fail"     // A task was recorded as failed
+	EventCancel   EventType = "cancel"   // A task was cancelled
+	EventExpire   EventType = "expire"   // A task was skipped past its deadline
+	EventSnapshot EventType = "snapshot" // A queued task was handed over by Snapshot
+	EventShutdown EventType = "shutdown" // Shutdown was called
+)
+
+// TaskStatus is where a task is in its lifecycle.
+type TaskStatus int
+
+const (
+	StatusQueued    TaskStatus = iota // Waiting in the queue, including between retries
+	StatusRunning                     // Being processed by a worker
+	StatusCompleted                   // Assigned successfully
+	StatusFailed                      // Failed for good
+	StatusCancelled                   // Cancelled by CancelTask
+	StatusExpired                     // Skipped because its deadline had passed
+)
+
+func (s TaskStatus) String() string {
+	switch s {
+	case StatusQueued:
+		return "queued"
+	case StatusRunning:
+		return "running"
+	case StatusCompleted:
+		return "completed"
+	case StatusFailed:
+		return "failed"
+	case StatusCancelled:
+		return "cancelled"
+	case StatusExpired:
+		return "expired"
+	default:
+		return fmt.Sprintf("TaskStatus(%d)", int(s))
+	}
+}
+
+// TaskStore records the latest status of every task by ID. It is safe for
+// concurrent use.
+type TaskStore struct {
+	mu       sync.Mutex
+	statuses map[string]TaskStatus
+}
+
+// NewTaskStore creates an empty store.
+func NewTaskStore() *TaskStore {
+	return &TaskStore{statuses: make(map[string]TaskStatus)}
+}
+
+// Set records status as the current status of task id.
+func (s *TaskStore) Set(id string, status TaskStatus) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.statuses[id] = status
+}
+
+// Get returns the current status of task id, and false if it is unknown.
+func (s *TaskStore) Get(id string) (TaskStatus, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status, ok := s.statuses[id]
+	return status, ok
+}
+
+// Delete forgets task id.
+func (s *TaskStore) Delete(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.statuses, id)
+}
+
+// clear forgets every task.
+func (s *TaskStore) clear() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	clear(s.statuses)
+}
+
+// eventStatuses maps the events that move a task through its lifecycle to
+// the status the task is in afterwards.
+var eventStatuses = map[EventType]TaskStatus{
+	EventSubmit:   StatusQueued,
+	EventStart:    StatusRunning,
+	EventComplete: StatusCompleted,
+	EventFail:     StatusFailed,
+	EventCancel:   StatusCancelled,
+	EventExpire:   StatusExpired,
+}
+
+// Event is one entry in the pool's audit log. WorkerID is zero for events
+// not raised by a worker, and TaskID is empty for pool-wide events.
+type Event struct {
+	Time     time.Time
+	Type     EventType
+	TaskID   string
+	WorkerID int
+	Err      error
+}
+
+// FailedTask records a task that could not be assigned and why.
+type FailedTask struct {
+	Task     Task
+	WorkerID int
+	Err      error
+	Reason   FailureReason
+}
+
+// FailureReason categorises why a task did not complete.
+type FailureReason int
+
+const (
+	FailureError             FailureReason = iota // Process returned an error
+	FailurePanic                                  // Process panicked
+	FailureTimeout                                // Process ran past TaskTimeout
+	FailureExpired                                // The task's Deadline passed
+	FailureDriverUnavailable                      // The driver was busy, its circuit breaker open, or every driver rejected it
+	FailureCancelled                              // The task or pool was cancelled
+	FailureInvalid                                // The task was malformed, e.g. had no rider
+	FailureRetryDropped                           // The task's retry was dropped from a full retry queue
+)
+
+func (r FailureReason) String() string {
+	switch r {
+	case FailureError:
+		return "error"
+	case FailurePanic:
+		return "panic"
+	case FailureTimeout:
+		return "timeout"
+	case FailureExpired:
+		return "expired"
+	case FailureDriverUnavailable:
+		return "driver_unavailable"
+	case FailureCancelled:
+		return "cancelled"
+	case FailureInvalid:
+		return "invalid"
+	case FailureRetryDropped:
+		return "retry_dropped"
+	default:
+		return fmt.Sprintf("FailureReason(%d)", int(r))
+	}
+}
+
+// failureReason classifies the error a task failed with.
+func failureReason(err error) FailureReason {
+	var pe *panicError
+	var busy *DriverBusyError
+	switch {
+	case errors.As(err, &pe):
+		return FailurePanic
+	case errors.Is(err, ErrTaskTimeout):
+		return FailureTimeout
+	case errors.Is(err, context.DeadlineExceeded):
+		return FailureExpired
+	case errors.As(err, &busy), errors.Is(err, ErrCircuitOpen), errors.Is(err, ErrAssignmentRejected):
+		return FailureDriverUnavailable
+	case errors.Is(err, ErrTaskCancelled), errors.Is(err, ErrPoolShutdown), errors.Is(err, context.Canceled):
+		return FailureCancelled
+	case errors.Is(err, ErrInvalidTask):
+		return FailureInvalid
+	case errors.Is(err, ErrRetryDropped):
+		return FailureRetryDropped
+	default:
+		return FailureError
+	}
+}
+
+// WorkerPool owns the task queue, the workers, and the shared results.
+// Callers interact with it only through Start, Submit, and Wait.
+// Exported fields are configuration and must be set before Start.
+type WorkerPool struct {
+	// TaskTimeout bounds each Process call; zero means no limit.
+	TaskTimeout time.Duration
+	// MaxRetries is how many times a failed task is retried before it is
+	// recorded as a failure.
+	MaxRetries int
+	// RetryBackoff is the base delay before a retry; attempt n waits
+	// RetryBackoff * 2^n. The retry is queued with StartAfter set that far
+	// ahead, so its worker moves on to other tasks in the meantime.
+	RetryBackoff time.Duration
+	// RetryPolicy, if set, decides whether a failed attempt's error is worth
+	// retrying; a task whose error it rejects fails straight away. nil
+	// retries every error up to MaxRetries.
+	RetryPolicy func(err error) bool
+	// RetryQueueSize, when set, sends retries to a separate queue of that
+	// size instead of back into the main one, so they never take a fresh
+	// task's place in the buffer or hold up Submit. Workers only take a
+	// retry when no fresh task is ready. When it is full the oldest retry is
+	// dropped and recorded as a failure with ErrRetryDropped.
+	RetryQueueSize int
+	// CoordinateMode decides what Submit does with a task whose coordinates
+	// are out of range: CoordinatesStrict, the default, lets it through to
+	// be recorded as a FailureInvalid failure, while CoordinatesNormalize
+	// brings them into range with NormalizeLocation first.
+	CoordinateMode CoordinateMode
+	// ResultTimeout, when set, bounds how long a worker waits for a slow
+	// Stream consumer to take a result. Once it passes, the pool logs a
+	// warning and keeps waiting, or, with DropSlowResults, drops the result
+	// and counts it in DroppedResults so the worker can move on.
+	ResultTimeout   time.Duration
+	DropSlowResults bool
+	// Acceptor, if set, makes every assignment two-phase: after Process
+	// proposes it, the driver must accept within AcceptTimeout (zero means
+	// no limit). A rejected task is requeued with another of its
+	// Candidates, chosen by Strategy, as its driver, without using a retry,
+	// and fails with ErrAssignmentRejected once none are left.
+	Acceptor      Acceptor
+	AcceptTimeout time.Duration
+	// Strategy, if set, chooses which of a rejected task's Candidates is
+	// offered the ride next, as a Matcher's strategy chooses drivers; nil
+	// offers them in order.
+	Strategy Strategy
+	// RateLimit caps how many tasks the whole pool processes per second;
+	// zero means unlimited. Tasks wait for their turn rather than being dropped.
+	RateLimit int
+	// OnComplete, if set, is called with every successful assignment.
+	// OnError, if set, is called with every task recorded as failed.
+	// Both run on the worker goroutine that finished the task, but the pool
+	// serializes them so no two callbacks ever run at the same time; a slow
+	// callback therefore holds up the other workers' callbacks.
+	OnComplete func(Result)
+	OnError    func(Task, error)
+	// RoundRobin hands tasks to workers strictly in turn through per-worker
+	// channels instead of letting them race on the shared queue. Work is
+	// spread evenly even when the Go scheduler would favour some workers,
+	// but a worker busy with a slow task holds up dispatch to everyone
+	// until it is ready for its next turn.
+	RoundRobin bool
+	// QueuePolicy decides what Submit does when the buffer is full: wait for
+	// room (QueueBlock, the default), let the buffer grow without bound
+	// (QueueGrow), or fail with ErrBufferFull (QueueReject). TrySubmit never
+	// waits, so it treats QueueBlock as QueueReject.
+	QueuePolicy QueuePolicy
+	// AgingRate raises a queued task's effective priority by this many points
+	// for every second it waits, so low-priority tasks cannot starve behind a
+	// steady stream of higher-priority ones; zero orders by Priority alone.
+	// A scheduled task only starts aging once its StartAfter arrives.
+	AgingRate float64
+	// RiderAffinity routes every task for a rider to the same worker, chosen
+	// by a hash of the rider's name over the running workers, so one rider's
+	// tasks run one at a time in submission order while different riders
+	// still run in parallel. It uses the same per-worker channels as
+	// RoundRobin, with the same head-of-line caveat, and takes precedence
+	// over it. Adding or removing workers changes which worker a rider maps to.
+	RiderAffinity bool
+	// Clock drives timeouts, deadlines, retry backoff, breaker cooldowns and
+	// result timing; nil means RealClock. The default SleepProcessor keeps
+	// its own Clock, so give it the same one to make a run fully simulated.
+	Clock Clock
+	// BreakerThreshold trips a driver's circuit breaker after that many
+	// consecutive failures; zero disables breakers. While open, the driver's
+	// tasks fail immediately with ErrCircuitOpen. After BreakerCooldown the
+	// breaker goes half-open and lets one trial task through.
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+	// Dedupe rejects a task whose key was already submitted, returning
+	// ErrDuplicateTask from Submit. KeyFunc computes the key; nil means
+	// Task.Key.
+	Dedupe  bool
+	KeyFunc func(Task) string
+	// SurgeThreshold is the number of waiting riders per worker above which
+	// SurgeMultiplier rises past 1.0; zero means defaultSurgeThreshold.
+	// MaxSurge caps the multiplier; zero means defaultMaxSurge.
+	SurgeThreshold float64
+	MaxSurge       float64
+	// Drivers is the registry of busy drivers. Give several pools the same
+	// registry to stop a driver being assigned in more than one of them at
+	// once; nil means the pool keeps its own.
+	Drivers *DriverRegistry
+	// StuckThreshold, when set, starts a monitor that reports a worker as
+	// stuck once its current task has run for longer than this. It is only
+	// diagnostic; stuck workers are logged and listed by StuckWorkers but
+	// left running.
+	StuckThreshold time.Duration
+	// MaxRetainedResults caps how many results Results keeps, discarding the
+	// oldest once exceeded so a long-running pool does not grow without
+	// bound; zero keeps them all. Metrics still counts every completion.
+	MaxRetainedResults int
+	// DryRun validates each task and logs the assignment it would make
+	// instead of running the processor, recording a result straight away
+	// for every valid task and a failure for every invalid one.
+	DryRun bool
+	// MaxConcurrent caps how many Process calls run at once, independently
+	// of the number of workers, e.g. to protect a downstream API while many
+	// workers keep pickup latency low; zero means no cap beyond the workers.
+	// A worker waiting for a slot holds its task and its driver.
+	MaxConcurrent int
+	// StartJitter, when set, delays each Process call by a random amount up
+	// to this long, so a burst of tasks does not hit a downstream service at
+	// the same instant. JitterSeed seeds the random source, making the delays
+	// reproducible; zero picks a random seed.
+	StartJitter time.Duration
+	JitterSeed  uint64
+	// PanicPolicy chooses between recovering panics in Process as task
+	// failures (the default) and letting them crash the program with the
+	// original stack, for operators who prefer to fail fast.
+	PanicPolicy PanicPolicy
+	// IdleTimeout, when set, shuts the pool down gracefully once no task has
+	// been submitted or finished for that long and none are queued or
+	// running, so a batch job ends by itself after its last task.
+	IdleTimeout time.Duration
+	// StartupRamp, when set, staggers the workers Start launches evenly
+	// across this window rather than starting them all at once, to smooth
+	// cold-start load. Each worker pulls tasks as soon as it is online.
+	StartupRamp time.Duration
+	// MaxQueueWait, when set, evicts a task that has waited in the queue
+	// longer than this by the time a worker picks it up, recording it as
+	// expired instead of running it, to bound how stale work can get. The
+	// wait counts from Submit, including time in a Queue backend, and
+	// restarts when a task is requeued for a retry. A scheduled task only
+	// starts waiting once its StartAfter arrives. Unlike
+	// TaskTimeout it never interrupts a task that has started.
+	MaxQueueWait time.Duration
+
+	logger     *slog.Logger            // Structured logger for pool and worker events
+	processor  TaskProcessor           // Business logic run for every task
+	tracer     Tracer                  // Starts a span per task attempt, if set
+	backend    Queue                   // Holds submitted tasks before tasks, if set
+	spans      map[string]*taskSpan    // Span of each task attempt in progress, when tracing
+	rateTicker *time.Ticker            // Paces Process calls when RateLimit is set
+	slots      chan struct{}           // Semaphore of MaxConcurrent Process tokens, if set
+	jitterMu   sync.Mutex              // Guards jitterRNG
+	jitterRNG  *rand.Rand              // Source of StartJitter delays, created by Start
+	callbackMu sync.Mutex              // Serializes OnComplete and OnError
+	finished   chan struct{}           // Closed once every worker has exited
+	startedAt  time.Time               // When Start was called, guarded by mu
+	finishedAt time.Time               // When finished was closed, guarded by mu
+	finishOnce sync.Once               // Guards closing finished
+	hooksMu    sync.Mutex              // Guards hooks and hookErr
+	hooks      []func() error          // OnShutdown hooks in registration order
+	hooksOnce  sync.Once               // Runs the hooks exactly once
+	hookErr    error                   // Joined errors from the hooks, once they have run
+	reporters  sync.WaitGroup          // Progress reporter goroutines
+	parent     context.Context         // The caller's context; running tasks observe it
+	genCtx     context.Context         // Derived from parent; running tasks' contexts derive from it
+	genCancel  context.CancelCauseFunc // Cancels genCtx; used by CancelAll
+	generation atomic.Uint64           // Bumped by CancelAll; written under mu with genCtx
+	ctx        context.Context         // Cancelling this stops every worker
+	cancel     context.CancelCauseFunc // Cancels ctx; used by Shutdown(false)
+	numWorkers int
+	capacities []int           // Capacity of each initial worker, from NewWeightedWorkerPool
+	tasks      *taskQueue      // Bounded priority queue to hold tasks
+	results    []Result        // Shared slice to store results
+	failures   []FailedTask    // Tasks that failed after exhausting their retries
+	cancelled  []Task          // Tasks removed or aborted by CancelTask
+	expired    []Task          // Tasks skipped past their Deadline or MaxQueueWait
+	panics     []PanicRecord   // Panics recovered from Process, with stacks
+	latencies  []time.Duration // Duration of every completed task, in completion order
+
+	fatalOnce sync.Once
+	fatalErr  error          // First FatalError hit by a task
+	errIn     chan TaskError // Feeds the Errors collector once Errors has been called
+	errOut    chan TaskError // Returned by Errors
+	errOnce   sync.Once
+
+	eventsMu sync.Mutex                         // Guards events
+	events   []Event                            // Audit log in the order events were recorded
+	store    *TaskStore                         // Latest status of every task, kept in step with events
+	running  map[string]context.CancelCauseFunc // Aborts the running task with the given ID
+	groups   map[string]*taskGroup              // Groups from SubmitGroup that have unsettled tasks
+	ordered  []*orderedStream                   // Streams from OrderedStream
+	mu       sync.Mutex                         // Mutex to guard the result, failure, cancellation, expiry and panic records
+	wg       sync.WaitGroup                     // WaitGroup to wait for all workers
+
+	drivers   *DriverRegistry            // Private registry used when Drivers is nil
+	driversMu sync.Mutex                 // Guards breakers
+	breakers  map[string]*circuitBreaker // Per-driver breakers, created on first failure
+
+	workersMu    sync.Mutex            // Guards workers, nextWorkerID, stats and stuck
+	workers      map[int]*workerHandle // Running workers keyed by ID
+	nextWorkerID int                   // Last ID handed out; IDs are never reused
+	stats        map[int]*workerRecord // Statistics for every worker ever started, by ID
+	stuck        []int                 // Workers the stuck monitor last flagged, sorted
+	workersAdded chan struct{}         // Nudges the round-robin dispatcher after AddWorkers
+	activity     chan struct{}         // Nudges the idle monitor on each submit and finished task
+	dispatched   chan struct{}         // Closed when the round-robin dispatcher exits
+
+	submitSeq atomic.Uint64 // Source of Task.Seq submission indices
+	dropped   atomic.Int64  // Stream results dropped under DropSlowResults
+	closed    atomic.Bool   // Set by Shutdown; Submit rejects tasks afterwards
+
+	seenMu   sync.Mutex          // Guards seenKeys
+	seenKeys map[string]struct{} // Keys submitted so far, when Dedupe is set
+
+	resetMu sync.RWMutex // Held for reading by submit and for writing by Reset
+
+	// Live counters, readable at any time through Metrics
+	submitted      atomic.Int64
+	completed      atomic.Int64
+	failed         atomic.Int64
+	cancelledCount atomic.Int64
+	expiredCount   atomic.Int64
+	inFlight       atomic.Int64
+}
+
+// workerHandle is the pool's view of one running worker.
+type workerHandle struct {
+	ctx    context.Context // Cancelled to remove the worker
+	cancel context.CancelFunc
+	inbox  chan Task     // Unbuffered; only used when dispatching
+	exited chan struct{} // Closed once the worker has returned
+	weight int           // Share of round-robin turns; see NewWeightedWorkerPool
+
+	// Heartbeat, guarded by the pool's workersMu
+	lastBeat  time.Time // When the worker came online or last started or finished a task
+	busySince time.Time // When the current task started; zero while idle
+}
+
+// Metrics is a point-in-time snapshot of the pool's counters.
+type Metrics struct {
+	Submitted int64 // Tasks accepted by Submit, excluding termination signals
+	Completed int64 // Tasks assigned successfully
+	Failed    int64 // Tasks recorded as failures after exhausting retries
+	Cancelled int64 // Tasks cancelled with CancelTask or CancelAll
+	Expired   int64 // Tasks skipped past their deadline or MaxQueueWait
+	InFlight  int64 // Tasks currently held by a worker
+}
+
+// HealthStatus is the pool's answer to a readiness probe.
+type HealthStatus struct {
+	Healthy    bool     `json:"healthy"`
+	Workers    int      `json:"workers"`     // Workers currently running
+	QueueDepth int      `json:"queue_depth"` // Tasks waiting, including scheduled ones
+	Stuck      []int    `json:"stuck,omitempty"`
+	Problems   []string `json:"problems,omitempty"` // Why Healthy is false
+}
+
+// defaultWorkers and defaultBufferSize size a pool built by NewWorkerPool
+// without WithWorkers or WithBuffer.
+const (
+	defaultWorkers    = 4
+	defaultBufferSize = 20
+)
+
+// poolConfig collects the settings given to NewWorkerPool.
+type poolConfig struct {
+	ctx        context.Context
+	workers    int
+	bufferSize int
+	logger     *slog.Logger
+	processor  TaskProcessor
+	configure  []func(*WorkerPool) // Applied in order once the pool exists
+}
+
+// Option configures a pool built by NewWorkerPool.
+type Option func(*poolConfig)
+
+// WithContext makes the pool stop when ctx is cancelled, as
+// NewWorkerPoolWithContext does. The default is context.Background().
+func WithContext(ctx context.Context) Option {
+	return func(c *poolConfig) { c.ctx = ctx }
+}
+
+// WithWorkers sets how many workers Start launches; the default is 4.
+func WithWorkers(n int) Option {
+	return func(c *poolConfig) { c.workers = n }
+}
+
+// WithBuffer sets the task buffer's capacity; the default is 20.
+func WithBuffer(n int) Option {
+	return func(c *poolConfig) { c.bufferSize = n }
+}
+
+// WithLogger sets the pool's logger; the default is slog.Default().
+func WithLogger(logger *slog.Logger) Option {
+	return func(c *poolConfig) { c.logger = logger }
+}
+
+// WithProcessor sets the processor run for every task; the default is
+// SleepProcessor.
+func WithProcessor(processor TaskProcessor) Option {
+	return func(c *poolConfig) { c.processor = processor }
+}
+
+// WithTimeout sets TaskTimeout.
+func WithTimeout(d time.Duration) Option {
+	return configure(func(p *WorkerPool) { p.TaskTimeout = d })
+}
+
+// WithRateLimit sets RateLimit.
+func WithRateLimit(perSecond int) Option {
+	return configure(func(p *WorkerPool) { p.RateLimit = perSecond })
+}
+
+// WithRetries sets MaxRetries and RetryBackoff.
+func WithRetries(maxRetries int, backoff time.Duration) Option {
+	return configure(func(p *WorkerPool) {
+		p.MaxRetries = maxRetries
+		p.RetryBackoff = backoff
+	})
+}
+
+// WithQueue keeps submitted tasks in q until the pool is ready for them,
+// instead of only in the pool's own buffer. The buffer then holds just the
+// tasks pulled from q and not yet picked up, and QueuePolicy does not apply:
+// Submit blocks or fails as q.Enqueue does, while TrySubmit gives up if q
+// has no room straight away.
+func WithQueue(q Queue) Option {
+	return configure(func(p *WorkerPool) { p.backend = q })
+}
+
+// WithTracer traces every task attempt with a span from tracer, named
+// "assign_ride" and parented by the context given to SubmitContext.
+func WithTracer(tracer Tracer) Option {
+	return configure(func(p *WorkerPool) { p.tracer = tracer })
+}
+
+// WithClock sets Clock.
+func WithClock(clock Clock) Option {
+	return configure(func(p *WorkerPool) { p.Clock = clock })
+}
+
+// configure wraps a change to the constructed pool as an Option.
+func configure(f func(*WorkerPool)) Option {
+	return func(c *poolConfig) { c.configure = append(c.configure, f) }
+}
+
+// NewWorkerPool creates a pool configured by opts, which are applied in
+// order. Without options it has 4 workers, a buffer of 20 tasks, the
+// default logger and the SleepProcessor. Any exported field can still be
+// set afterwards, before Start.
+func NewWorkerPool(opts ...Option) *WorkerPool {
+	c := poolConfig{ctx: context.Background(), workers: defaultWorkers, bufferSize: defaultBufferSize}
+	for _, opt := range opts {
+		opt(&c)
+	}
+
+	p := NewWorkerPoolWithProcessor(c.ctx, c.workers, c.bufferSize, c.logger, c.processor)
+	for _, f := range c.configure {
+		f(p)
+	}
+	return p
+}
+
+// NewWorkerPoolWithContext creates a pool whose workers stop as soon as ctx is
+// cancelled, even while they are waiting for a task.
+func NewWorkerPoolWithContext(ctx context.Context, numWorkers, bufferSize int) *WorkerPool {
+	return NewWorkerPoolWithLogger(ctx, numWorkers, bufferSize, nil)
+}
+
+// DiscardLogger returns a logger that drops every record, for running a pool
+// silently in tests and benchmarks.
+func DiscardLogger() *slog.Logger {
+	return slog.New(slog.DiscardHandler)
+}
+
+// NewWorkerPoolWithLogger creates a pool that writes its structured logs to
+// logger, or to slog.Default() when logger is nil. Pass DiscardLogger() to
+// silence the pool entirely.
+func NewWorkerPoolWithLogger(ctx context.Context, numWorkers, bufferSize int, logger *slog.Logger) *WorkerPool {
+	return NewWorkerPoolWithProcessor(ctx, numWorkers, bufferSize, logger, nil)
+}
+
+// NewWeightedWorkerPool creates a round-robin pool with one worker per entry
+// in capacities, where a worker's capacity sets its share of tasks: a worker
+// of capacity 3 is handed three tasks for every one given to a worker of
+// capacity 1, so faster machines can take more of the load. Capacities below
+// one count as one, as do workers added later with AddWorkers. Workers still
+// take one task at a time from an unbuffered inbox, because tasks buffered
+// for a worker would be stranded if it were removed.
+func NewWeightedWorkerPool(ctx context.Context, capacities []int, bufferSize int, logger *slog.Logger) *WorkerPool {
+	p := NewWorkerPoolWithLogger(ctx, len(capacities), bufferSize, logger)
+	p.RoundRobin = true
+	p.capacities = slices.Clone(capacities)
+	return p
+}
+
+// NewWorkerPoolWithProcessor creates a pool whose workers hand each task to
+// processor, or to SleepProcessor when processor is nil. A nil logger means
+// slog.Default().
+func NewWorkerPoolWithProcessor(ctx context.Context, numWorkers, bufferSize int, logger *slog.Logger, processor TaskProcessor) *WorkerPool {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	if processor == nil {
+		processor = SleepProcessor{}
+	}
+
+	parent := ctx
+	genCtx, genCancel := context.WithCancelCause(parent)
+	ctx, cancel := context.WithCancelCause(ctx)
+	p := &WorkerPool{
+		parent:     parent,
+		genCtx:     genCtx,
+		genCancel:  genCancel,
+		logger:     logger,
+		processor:  processor,
+		ctx:        ctx,
+		cancel:     cancel,
+		numWorkers: numWorkers,
+		tasks:      newTaskQueue(bufferSize),
+		workers:    make(map[int]*workerHandle),
+		finished:   make(chan struct{}),
+
+		stats:        make(map[int]*workerRecord),
+		workersAdded: make(chan struct{}, 1),
+		activity:     make(chan struct{}, 1),
+		dispatched:   make(chan struct{}),
+		running:      make(map[string]context.CancelCauseFunc),
+		spans:        make(map[string]*taskSpan),
+		groups:       make(map[string]*taskGroup),
+		store:        NewTaskStore(),
+
+		drivers:  NewDriverRegistry(),
+		breakers: make(map[string]*circuitBreaker),
+		seenKeys: make(map[string]struct{}),
+	}
+	p.tasks.clock = p.clock // Looked up on each use, so a Clock set later applies
+	p.tasks.aging = func() float64 { return p.AgingRate }
+	p.tasks.retryCap = func() int { return p.RetryQueueSize }
+	return p
+}
+
+// Start launches the initial worker goroutines.
+func (p *WorkerPool) Start() {
+	p.mu.Lock()
+	p.startedAt = p.clock().Now()
+	p.mu.Unlock()
+	if p.RateLimit > 0 {
+		p.rateTicker = time.NewTicker(time.Second / time.Duration(p.RateLimit))
+	}
+	if p.MaxConcurrent > 0 {
+		p.slots = make(chan struct{}, p.MaxConcurrent)
+	}
+	if p.StartJitter > 0 {
+		seed := p.JitterSeed
+		if seed == 0 {
+			seed = rand.Uint64()
+		}
+		p.jitterRNG = rand.New(rand.NewPCG(seed, seed))
+	}
+	if p.StartupRamp > 0 && p.numWorkers > 1 {
+		p.AddWorkers(1)
+		p.reporters.Add(1)
+		go p.ramp(p.numWorkers - 1)
+	} else {
+		p.AddWorkers(p.numWorkers)
+	}
+	if p.backend != nil {
+		p.wg.Add(1)
+		go p.pump()
+	}
+	if p.dispatching() {
+		p.wg.Add(1)
+		go p.dispatch()
+	}
+	if p.StuckThreshold > 0 {
+		p.reporters.Add(1)
+		go p.monitorStuck()
+	}
+	if p.IdleTimeout > 0 {
+		p.reporters.Add(1)
+		go p.monitorIdle()
+	}
+}
+
+// Restart replaces every worker with n fresh ones, for example to change the
+// pool's size from scratch. Current workers finish the task they are running
+// and exit; queued tasks stay queued and are picked up by the new workers,
+// so nothing is lost or run twice. It returns once the old workers have
+// exited and does nothing once the pool has been shut down.
+func (p *WorkerPool) Restart(n int) {
+	if p.tasks.isClosed() {
+		p.logger.Warn("pool shut down, not restarting", "event", "restart", "count", n)
+		return
+	}
+
+	p.workersMu.Lock()
+	old := make([]*workerHandle, 0, len(p.workers))
+	for id, h := range p.workers {
+		h.cancel()
+		delete(p.workers, id)
+		old = append(old, h)
+	}
+	p.workersMu.Unlock()
+
+	for _, h := range old {
+		<-h.exited
+	}
+	p.logger.Info("restarting workers", "event", "restart", "stopped", len(old), "count", n)
+	p.AddWorkers(n)
+}
+
+// AddWorkers launches n more workers, each with a fresh ID. It does nothing
+// once the pool has been shut down.
+func (p *WorkerPool) AddWorkers(n int) {
+	p.workersMu.Lock()
+	defer p.workersMu.Unlock()
+
+	if p.tasks.isClosed() {
+		p.logger.Warn("pool shut down, not adding workers", "event", "add_workers", "count", n)
+		return
+	}
+
+	for i := 0; i < n; i++ {
+		p.nextWorkerID++
+		id := p.nextWorkerID
+		ctx, cancel := context.WithCancel(p.ctx)
+		now := p.clock().Now()
+		h := &workerHandle{ctx: ctx, cancel: cancel, exited: make(chan struct{}), weight: 1, lastBeat: now}
+		if id <= len(p.capacities) {
+			h.weight = max(p.capacities[id-1], 1)
+		}
+		if p.dispatching() {
+			h.inbox = make(chan Task)
+		}
+		p.workers[id] = h
+		p.stats[id] = &workerRecord{stats: WorkerStats{WorkerID: id}, started: now}
+
+		p.wg.Add(1)
+		go p.worker(id, h)
+	}
+
+	select {
+	case p.workersAdded <- struct{}{}:
+	default: // A nudge is already pending
+	}
+}
+
+// ramp adds n workers one at a time, spaced evenly so that together with the
+// first worker they come online across StartupRamp. It stops early if the
+// pool shuts down.
+func (p *WorkerPool) ramp(n int) {
+	defer p.reporters.Done()
+	interval := p.StartupRamp / time.Duration(n+1)
+
+	for range n {
+		select {
+		case <-p.clock().After(interval):
+			p.AddWorkers(1)
+		case <-p.finished:
+			return
+		}
+	}
+}
+
+// RemoveWorkers stops up to n of the most recently added workers. Each one
+// finishes its current task before exiting.
+func (p *WorkerPool) RemoveWorkers(n int) {
+	p.workersMu.Lock()
+	defer p.workersMu.Unlock()
+
+	ids := make([]int, 0, len(p.workers))
+	for id := range p.workers {
+		ids = append(ids, id)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(ids)))
+
+	for _, id := range ids[:min(n, len(ids))] {
+		p.workers[id].cancel()
+		delete(p.workers, id)
+	}
+}
+
+// WorkerTaskCounts returns how many tasks each worker has handled, keyed by
+// worker ID. Workers that have exited are included.
+func (p *WorkerPool) WorkerTaskCounts() map[int]int {
+	p.workersMu.Lock()
+	defer p.workersMu.Unlock()
+	counts := make(map[int]int, len(p.stats))
+	for id, rec := range p.stats {
+		counts[id] = rec.stats.Tasks
+	}
+	return counts
+}
+
+// WorkerStats describes how one worker has performed.
+type WorkerStats struct {
+	WorkerID int
+	Tasks    int           // Tasks handled, however they ended
+	Failures int           // Tasks that failed for good on this worker
+	Busy     time.Duration // Time spent handling tasks
+	Idle     time.Duration // Time alive but not handling a task
+	Started  time.Time     // When the worker came online
+}
+
+// workerRecord accumulates a worker's statistics.
+type workerRecord struct {
+	stats   WorkerStats
+	started time.Time
+	stopped time.Time // Zero while the worker is running
+}
+
+// WorkerStats returns statistics for every worker the pool has started,
+// including ones that have exited, ordered by worker ID. Idle time for a
+// running worker is counted up to now.
+func (p *WorkerPool) WorkerStats() []WorkerStats {
+	now := p.clock().Now()
+	p.workersMu.Lock()
+	defer p.workersMu.Unlock()
+
+	out := make([]WorkerStats, 0, len(p.stats))
+	for _, rec := range p.stats {
+		s := rec.stats
+		end := rec.stopped
+		if end.IsZero() {
+			end = now
+		}
+		s.Idle = max(end.Sub(rec.started)-s.Busy, 0)
+		s.Started = rec.started
+		out = append(out, s)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].WorkerID < out[j].WorkerID })
+	return out
+}
+
+// dispatching reports whether tasks reach workers through the dispatcher
+// rather than straight from the shared queue.
+func (p *WorkerPool) dispatching() bool {
+	return p.RoundRobin || p.RiderAffinity
+}
+
+// dispatch feeds tasks from the shared queue to workers one at a time, when
+// RoundRobin or RiderAffinity is set. In round-robin mode workers take turns
+// in ascending ID order, and those with a higher weight get proportionally
+// more turns, spread evenly through the rotation.
+func (p *WorkerPool) dispatch() {
+	defer p.wg.Done()
+	defer close(p.dispatched) // Tells idle workers there is nothing more to come
+
+	turns := make(map[int]int) // Smooth weighted round-robin credit per worker ID
+	for {
+		task, ok := p.tasks.pop(p.ctx)
+		if !ok {
+			return
+		}
+		for !p.deliver(turns, task) {
+			if p.ctx.Err() != nil {
+				return
+			}
+		}
+	}
+}
+
+// deliver offers task to the worker its rider maps to under RiderAffinity,
+// or otherwise to the worker whose turn it is. It returns false if that
+// worker was removed first, or there are no workers yet, so the caller can
+// try again.
+func (p *WorkerPool) deliver(turns map[int]int, task Task) bool {
+	p.workersMu.Lock()
+	ids := make([]int, 0, len(p.workers))
+	for id := range p.workers {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	var next *workerHandle
+	if p.RiderAffinity {
+		next = p.affinityWorker(ids, task.Rider)
+	} else {
+		next = p.nextTurn(ids, turns)
+	}
+	p.workersMu.Unlock()
+
+	if next == nil {
+		// Nobody to hand the task to; wait for AddWorkers
+		select {
+		case <-p.workersAdded:
+		case <-p.ctx.Done():
+		}
+		return false
+	}
+
+	select {
+	case next.inbox <- task:
+		return true
+	case <-next.ctx.Done():
+		return false // Skip the removed worker
+	case <-p.ctx.Done():
+		return false
+	}
+}
+
+// affinityWorker returns the worker rider hashes to among ids, or nil if
+// there are none. The caller holds workersMu.
+func (p *WorkerPool) affinityWorker(ids []int, rider string) *workerHandle {
+	if len(ids) == 0 {
+		return nil
+	}
+	h := fnv.New32a()
+	h.Write([]byte(rider))
+	return p.workers[ids[h.Sum32()%uint32(len(ids))]]
+}
+
+// nextTurn returns the worker whose turn it is among ids, using the same
+// smooth weighted round-robin as WeightedRoundRobinStrategy over the credit
+// kept in turns; with equal weights this visits workers in ascending ID
+// order. It returns nil if there are no workers. The caller holds workersMu.
+func (p *WorkerPool) nextTurn(ids []int, turns map[int]int) *workerHandle {
+	for id := range turns {
+		if _, ok := p.workers[id]; !ok {
+			delete(turns, id) // Forget removed workers
+		}
+	}
+
+	nextID, total := 0, 0
+	for _, id := range ids {
+		turns[id] += p.workers[id].weight
+		total += p.workers[id].weight
+		if nextID == 0 || turns[id] > turns[nextID] {
+			nextID = id
+		}
+	}
+	if nextID != 0 {
+		turns[nextID] -= total
+	}
+	return p.workers[nextID]
+}
+
+// NumWorkers returns how many workers are currently running.
+func (p *WorkerPool) NumWorkers() int {
+	p.workersMu.Lock()
+	defer p.workersMu.Unlock()
+	return len(p.workers)
+}
+
+// WorkerIDs returns the IDs of the running workers in ascending order. IDs
+// are handed out in sequence as workers are added, starting at 1, and are
+// never reused within a pool's lifetime, even after RemoveWorkers, Restart
+// or Reset, so an ID in the logs or in WorkerStats names one worker only.
+func (p *WorkerPool) WorkerIDs() []int {
+	p.workersMu.Lock()
+	defer p.workersMu.Unlock()
+	return slices.Sorted(maps.Keys(p.workers))
+}
+
+// Submit sends a task to the pool, handling a full buffer according to
+// QueuePolicy: by default it blocks until there is room. It returns
+// ErrBufferFull if the policy rejected the task, ErrPoolClosed once the pool
+// has been shut down, or the context's cancellation cause if the pool is
+// cancelled before the task is queued.
+// Submit may race freely with Shutdown: the queue is a mutex-guarded heap
+// rather than a channel, and its closed flag is checked under the same lock
+// as every push, so a late Submit is rejected with ErrPoolClosed instead of
+// panicking on a send to a closed channel.
+func (p *WorkerPool) Submit(task Task) error {
+	return p.submit(task, true)
+}
+
+// SubmitContext submits a task like Submit, recording ctx as the parent of
+// the task's tracing spans so they join the caller's trace. ctx is not
+// otherwise used: blocking and cancellation follow the pool, as for Submit.
+func (p *WorkerPool) SubmitContext(ctx context.Context, task Task) error {
+	task.submitCtx = ctx
+	return p.submit(task, true)
+}
+
+// TrySubmit queues a task without blocking. It returns false if the queue is
+// full or the pool is no longer accepting tasks, leaving the caller to shed
+// or retry the task as it sees fit.
+func (p *WorkerPool) TrySubmit(task Task) bool {
+	return p.submit(task, false) == nil
+}
+
+// SubmitBatch submits tasks in order as Submit does, by default blocking
+// whenever the buffer is full. It returns how many were queued, which is
+// less than len(tasks) only if the pool shut down or was cancelled, or the
+// buffer filled under QueueReject, part-way through the batch.
+func (p *WorkerPool) SubmitBatch(tasks []Task) int {
+	for i, task := range tasks {
+		if p.submit(task, true) != nil {
+			return i
+		}
+	}
+	return len(tasks)
+}
+
+// submit queues a task, returning why it was rejected if it was not
+// accepted. It waits for room in the queue only if wait is set.
+func (p *WorkerPool) submit(task Task, wait bool) error {
+	p.resetMu.RLock()
+	defer p.resetMu.RUnlock()
+	if p.closed.Load() {
+		return ErrPoolClosed
+	}
+
+	dedupe := p.Dedupe && !task.IsTerminationSignal
+	if dedupe && !p.claimKey(task) {
+		p.logger.Warn("duplicate task rejected", "event", "duplicate",
+			"task_id", task.ID, "rider", task.Rider, "driver", task.Driver)
+		return ErrDuplicateTask
+	}
+
+	// Count and log before pushing so a fast worker never completes more
+	// than was submitted, or starts a task before its submit event
+	if !task.IsTerminationSignal {
+		if p.CoordinateMode == CoordinatesNormalize {
+			task = task.Normalized()
+		}
+		task.Seq = p.submitSeq.Add(1)
+		task.generation = p.generation.Load()
+		now := p.clock().Now()
+		if task.EnqueuedAt.IsZero() {
+			task.EnqueuedAt = now
+		}
+		task.queuedAt = queueStart(task, now)     // Time in a backend counts towards MaxQueueWait
+		task.Metadata = maps.Clone(task.Metadata) // The caller may go on to change its map
+		p.submitted.Add(1)
+		p.recordEvent(EventSubmit, task.ID, 0, nil)
+	}
+	policy := p.QueuePolicy
+	if !wait && policy == QueueBlock {
+		policy = QueueReject
+	}
+	var err error
+	if p.backend != nil {
+		ctx := p.ctx
+		if !wait {
+			// An ended context makes Enqueue give up rather than wait for room
+			var cancel context.CancelCauseFunc
+			ctx, cancel = context.WithCancelCause(ctx)
+			cancel(ErrBufferFull)
+		}
+		err = p.backend.Enqueue(ctx, task)
+	} else {
+		err = p.tasks.push(p.ctx, task, policy)
+	}
+	if err != nil {
+		if !task.IsTerminationSignal {
+			p.submitted.Add(-1)
+			p.recordEvent(EventDrop, task.ID, 0, err)
+			p.settleOrdered(task.Seq, nil) // Its index is spent; ordered streams skip it
+		}
+		if dedupe {
+			p.releaseKey(task) // Never queued, so it may be submitted again
+		}
+		if err != ErrBufferFull {
+			p.logger.Warn("pool not accepting tasks, dropping task", "event", "drop",
+				"task_id", task.ID, "rider", task.Rider, "driver", task.Driver, "error", err)
+		}
+		return err
+	}
+	p.touch()
+	return nil
+}
+
+// taskKey returns the dedupe key for task.
+func (p *WorkerPool) taskKey(task Task) string {
+	if p.KeyFunc != nil {
+		return p.KeyFunc(task)
+	}
+	return task.Key()
+}
+
+// claimKey records task's key, returning false if it was already seen.
+func (p *WorkerPool) claimKey(task Task) bool {
+	key := p.taskKey(task)
+	p.seenMu.Lock()
+	defer p.seenMu.Unlock()
+	if _, seen := p.seenKeys[key]; seen {
+		return false
+	}
+	p.seenKeys[key] = struct{}{}
+	return true
+}
+
+// releaseKey forgets task's key.
+func (p *WorkerPool) releaseKey(task Task) {
+	key := p.taskKey(task)
+	p.seenMu.Lock()
+	defer p.seenMu.Unlock()
+	delete(p.seenKeys, key)
+}
+
+// Shutdown stops the pool from accepting new tasks and blocks until every
+// worker has exited. With drain set, workers first finish everything already
+// queued; otherwise each worker stops after its current task. Workers are
+// stopped through the queue and the pool context, so no termination signals
+// need to be sent.
+func (p *WorkerPool) Shutdown(drain bool) {
+	p.beginShutdown() // Close the queue first so racing submits see ErrPoolClosed
+	if !drain {
+		p.cancel(ErrPoolShutdown)
+	}
+	p.wg.Wait() // Wait for all workers to complete
+	p.finish()
+}
+
+// ShutdownWithTimeout drains the pool like Shutdown(true), but for at most
+// d. If the queue has not drained by then, it stops workers through the
+// pool context and aborts the tasks they are running, which are recorded as
+// failures caused by ErrPoolShutdown. It returns how many tasks were left
+// undone: those still queued plus those aborted.
+func (p *WorkerPool) ShutdownWithTimeout(d time.Duration) int {
+	p.beginShutdown()
+
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+
+	aborted := 0
+	select {
+	case <-done:
+	case <-p.clock().After(d):
+		p.logger.Warn("drain timed out, stopping workers", "event", "drain_timeout", "timeout", d)
+		p.cancel(ErrPoolShutdown)
+		p.mu.Lock()
+		for _, cancel := range p.running {
+			cancel(ErrPoolShutdown)
+			aborted++
+		}
+		p.mu.Unlock()
+		<-done
+	}
+	p.finish()
+
+	return p.queueLen() + aborted
+}
+
+// beginShutdown marks the pool closed and closes the queue, resuming it if
+// paused so that workers can drain it or see that it is closed.
+func (p *WorkerPool) beginShutdown() {
+	if !p.closed.Swap(true) {
+		p.recordEvent(EventShutdown, "", 0, nil)
+	}
+	if p.backend != nil {
+		// The pump closes tasks once it has pulled what is left
+		if err := p.backend.Close(); err != nil {
+			p.logger.Error("closing queue backend", "event", "shutdown", "error", err)
+		}
+	} else {
+		p.tasks.close() // No more tasks will be added
+	}
+	p.tasks.setPaused(false)
+}
+
+// Pause stops workers from picking up new tasks until Resume is called.
+// Tasks already running finish normally, and Submit keeps queueing tasks
+// while there is room. Idle workers block rather than poll. Shutdown resumes
+// a paused pool.
+func (p *WorkerPool) Pause() {
+	p.tasks.setPaused(true)
+	p.logger.Info("pool paused", "event", "pause")
+}
+
+// Resume lets workers pick up tasks again after Pause.
+func (p *WorkerPool) Resume() {
+	p.tasks.setPaused(false)
+	p.logger.Info("pool resumed", "event", "resume")
+}
+
+// finish releases the pool's resources once every worker has exited.
+func (p *WorkerPool) finish() {
+	if p.rateTicker != nil {
+		p.rateTicker.Stop()
+	}
+
+	p.finishOnce.Do(func() {
+		close(p.finished)
+
+		p.mu.Lock()
+		p.finishedAt = p.clock().Now()
+		if p.errIn != nil {
+			close(p.errIn) // The collector closes the Errors channel once drained
+			p.errIn = nil
+		}
+		p.mu.Unlock()
+	})
+	p.reporters.Wait() // Progress reporters exit once finished is closed
+	p.hooksOnce.Do(p.runShutdownHooks)
+
+	p.cancel(ErrPoolShutdown) // Release the pool context now that nothing uses it
+	p.mu.Lock()
+	p.genCancel(ErrPoolShutdown)
+	p.mu.Unlock()
+}
+
+// RunAll is a convenience for batch runs and benchmarks: it creates a pool
+// of numWorkers running processor (SleepProcessor if nil) with its logs
+// discarded, submits every task, waits for them all, and returns the results
+// and any fatal error, as Wait does. SleepProcessor still prints each
+// assignment to stdout, as Task.Process does, so benchmarks should pass a
+// processor of their own. Every goroutine the pool started has exited by the
+// time it returns.
+func RunAll(numWorkers int, processor TaskProcessor, tasks []Task) ([]Result, error) {
+	p := NewWorkerPoolWithProcessor(context.Background(), numWorkers, len(tasks), DiscardLogger(), processor)
+	p.Start()
+	p.SubmitBatch(tasks)
+	return p.Wait()
+}
+
+// StartProgressReporter prints a progress line such as
+// "processed 6/10 (2 in flight)" every interval until the pool shuts down.
+// Shutdown and Wait do not return until the reporter has stopped.
+func (p *WorkerPool) StartProgressReporter(interval time.Duration) {
+	p.reporters.Add(1)
+	go func() {
+		defer p.reporters.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				m := p.Metrics()
+				fmt.Printf("processed %d/%d (%d in flight)\n", m.Processed(), m.Submitted, m.InFlight)
+			case <-p.finished:
+				return
+			}
+		}
+	}()
+}
+
+// SubmitMatches runs m.Match and submits every resulting task, returning how
+// many were submitted.
+func (p *WorkerPool) SubmitMatches(m *Matcher) int {
+	return p.SubmitBatch(m.Match())
+}
+
+// taskStream tracks the tasks submitted through one call to Stream.
+type taskStream struct {
+	out     chan Result
+	pending atomic.Int64  // Submitted tasks that have not yet settled
+	settled chan struct{} // Nudged each time one of the stream's tasks settles
+}
+
+// Stream submits every task received from tasks and emits the result of
+// each one that completes on the returned channel, so the pool can sit in
+// the middle of a larger pipeline. Tasks that fail, are cancelled or expire
+// produce no result. The channel is closed once tasks is closed and all of
+// its tasks have settled, or when the pool shuts down. The pool must be
+// started, and the caller must keep receiving from the channel, since
+// workers block until their result is taken; see ResultTimeout for bounding
+// that wait.
+func (p *WorkerPool) Stream(tasks <-chan Task) <-chan Result {
+	s := &taskStream{out: make(chan Result), settled: make(chan struct{}, 1)}
+
+	p.reporters.Add(1) // Shutdown waits for the stream to close
+	go func() {
+		defer p.reporters.Done()
+		defer close(s.out)
+
+		in := tasks
+		for in != nil || s.pending.Load() > 0 {
+			select {
+			case task, ok := <-in:
+				if !ok {
+					in = nil // Stop receiving, but wait for pending tasks
+					continue
+				}
+				// Carried by the task rather than looked up by its ID,
+				// which callers choose and need not keep unique
+				task.stream = s
+				s.pending.Add(1)
+				if err := p.Submit(task); err != nil {
+					s.pending.Add(-1)
+				}
+			case <-s.settled:
+			case <-p.finished:
+				return // Workers have exited, so nothing more will settle
+			}
+		}
+	}()
+	return s.out
+}
+
+// taskGroup tracks the tasks submitted through one call to SubmitGroup.
+type taskGroup struct {
+	remaining int // Tasks not yet settled
+	results   []Result
+	onDone    func([]Result)
+}
+
+// groupSeq is the source of group IDs.
+var groupSeq atomic.Uint64
+
+// SubmitGroup submits tasks like SubmitBatch, tagging them with a new group
+// ID, and calls onDone once every queued task in the group has settled. It
+// receives the results of the group's tasks that completed, in submission
+// order; tasks that failed, were cancelled or expired have none. Groups may
+// overlap freely. onDone is serialized with the other callbacks, and is
+// called straight away if no task could be queued. SubmitGroup returns how
+// many tasks were queued.
+func (p *WorkerPool) SubmitGroup(tasks []Task, onDone func([]Result)) int {
+	id := fmt.Sprintf("group-%d", groupSeq.Add(1))
+	p.mu.Lock()
+	// Count every task up front so one finishing early cannot fire onDone
+	p.groups[id] = &taskGroup{remaining: len(tasks) + 1, onDone: onDone}
+	p.mu.Unlock()
+
+	queued := 0
+	for _, task := range tasks {
+		task.GroupID = id
+		if p.submit(task, true) != nil {
+			break
+		}
+		queued++
+	}
+
+	// Release the tasks that were never queued, plus the submitter's share
+	p.settleGroup(id, nil, len(tasks)-queued+1)
+	return queued
+}
+
+// settle hands a finished task's outcome to the stream and group it belongs
+// to, if any. A nil result means the task ended without one.
+func (p *WorkerPool) settle(task Task, result *Result) {
+	p.settleStream(task.stream, result)
+	p.settleOrdered(task.Seq, result)
+	if task.GroupID != "" {
+		p.settleGroup(task.GroupID, result, 1)
+	}
+}
+
+// settleGroup counts n of group id's tasks as settled, keeping result if
+// there is one, and calls the group's callback once none remain.
+func (p *WorkerPool) settleGroup(id string, result *Result, n int) {
+	p.mu.Lock()
+	g, ok := p.groups[id]
+	if !ok {
+		p.mu.Unlock()
+		return
+	}
+	if result != nil {
+		g.results = append(g.results, *result)
+	}
+	g.remaining -= n
+	if g.remaining > 0 {
+		p.mu.Unlock()
+		return
+	}
+	delete(p.groups, id)
+	p.mu.Unlock()
+
+	sort.Slice(g.results, func(i, j int) bool { return g.results[i].Seq < g.results[j].Seq })
+	if g.onDone != nil {
+		p.serialized(func() { g.onDone(g.results) })
+	}
+}
+
+// settleStream hands a task's outcome to s, the stream that submitted it,
+// if any. A nil result means the task ended without one.
+func (p *WorkerPool) settleStream(s *taskStream, result *Result) {
+	if s == nil {
+		return
+	}
+
+	if result != nil {
+		p.sendResult(s.out, *result)
+	}
+	s.pending.Add(-1)
+	select {
+	case s.settled <- struct{}{}:
+	default: // A nudge is already pending
+	}
+}
+
+// sendResult delivers result on out, giving up after ResultTimeout when
+// DropSlowResults is set.
+func (p *WorkerPool) sendResult(out chan<- Result, result Result) {
+	if p.ResultTimeout <= 0 {
+		out <- result
+		return
+	}
+	select {
+	case out <- result:
+		return
+	case <-p.clock().After(p.ResultTimeout):
+	}
+
+	logger := p.logger.With("task_id", result.TaskID, "worker_id", result.WorkerID)
+	if p.DropSlowResults {
+		p.dropped.Add(1)
+		logger.Warn("result consumer too slow, dropping result", "event", "result_dropped", "timeout", p.ResultTimeout)
+		return
+	}
+	logger.Warn("result consumer slow", "event", "slow_consumer", "timeout", p.ResultTimeout)
+	out <- result
+}
+
+// DroppedResults returns how many Stream results were dropped because the
+// consumer did not take them within ResultTimeout.
+func (p *WorkerPool) DroppedResults() int64 {
+	return p.dropped.Load()
+}
+
+// orderedStream tracks one OrderedStream subscriber.
+type orderedStream struct {
+	out     chan Result
+	mu      sync.Mutex
+	next    uint64             // Submission index of the next task to emit
+	done    map[uint64]*Result // Settled tasks not yet emitted, by index; nil if a task has no result
+	settled chan struct{}      // Nudged each time a task settles
+}
+
+// OrderedStream emits the result of every task submitted from now on in
+// submission order, as soon as all earlier tasks have settled. Results that
+// complete out of order are buffered inside the pool, so workers never wait
+// on the receiver. Tasks that fail, are cancelled or expire are skipped
+// rather than holding up the tasks behind them. The channel is closed once
+// the pool has shut down and every result has been emitted; the caller must
+// keep receiving until then, since Shutdown waits for it.
+func (p *WorkerPool) OrderedStream() <-chan Result {
+	s := &orderedStream{
+		out:     make(chan Result),
+		done:    make(map[uint64]*Result),
+		settled: make(chan struct{}, 1),
+	}
+	p.mu.Lock()
+	// Registered under mu, so any task that takes a later index settles
+	// after the stream is listening
+	s.next = p.submitSeq.Load() + 1
+	p.ordered = append(p.ordered, s)
+	p.mu.Unlock()
+
+	p.reporters.Add(1) // Shutdown waits for the stream to close
+	go func() {
+		defer p.reporters.Done()
+		defer close(s.out)
+
+		for {
+			for _, result := range s.ready(false) {
+				s.out <- result
+			}
+			select {
+			case <-s.settled:
+			case <-p.finished:
+				// Workers have exited, so nothing more will settle; emit
+				// what is buffered, passing over any gaps
+				for _, result := range s.ready(true) {
+					s.out <- result
+				}
+				return
+			}
+		}
+	}()
+	return s.out
+}
+
+// ready removes and returns the buffered results that can be emitted now:
+// those of consecutive settled tasks from next, or every buffered result in
+// index order if all is set.
+func (s *orderedStream) ready(all bool) []Result {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var results []Result
+	for {
+		result, ok := s.done[s.next]
+		if !ok {
+			if !all || len(s.done) == 0 {
+				break
+			}
+			s.next = slices.Min(slices.Collect(maps.Keys(s.done))) // Skip the gap
+			continue
+		}
+		delete(s.done, s.next)
+		s.next++
+		if result != nil {
+			results = append(results, *result)
+		}
+	}
+	return results
+}
+
+// settleOrdered hands the outcome of the task with submission index seq to
+// every ordered stream. A nil result means the task ended without one.
+func (p *WorkerPool) settleOrdered(seq uint64, result *Result) {
+	p.mu.Lock()
+	streams := slices.Clone(p.ordered)
+	p.mu.Unlock()
+
+	for _, s := range streams {
+		s.mu.Lock()
+		if seq >= s.next {
+			s.done[seq] = result
+		}
+		s.mu.Unlock()
+		select {
+		case s.settled <- struct{}{}:
+		default: // A nudge is already pending
+		}
+	}
+}
+
+// Wait drains the queue, waits for all workers to complete, and returns the
+// collected results along with the first fatal error, if any, as Err does,
+// joined with any errors from OnShutdown hooks. Ordinary task failures are
+// not errors here; see Failures.
+func (p *WorkerPool) Wait() ([]Result, error) {
+	p.Shutdown(true)
+	p.hooksMu.Lock()
+	hookErr := p.hookErr
+	p.hooksMu.Unlock()
+	return p.Results(), errors.Join(p.Err(), hookErr)
+}
+
+// OnShutdown registers hook to run during shutdown, after every worker has
+// exited and before Shutdown or Wait returns; use it to flush logs or close
+// connections the processor uses. Hooks run once, most recently registered
+// first, and errors they return are reported by Wait. Register hooks before
+// shutting down; one added afterwards is never run.
+func (p *WorkerPool) OnShutdown(hook func() error) {
+	p.hooksMu.Lock()
+	defer p.hooksMu.Unlock()
+	p.hooks = append(p.hooks, hook)
+}
+
+// runShutdownHooks runs the OnShutdown hooks in reverse order of
+// registration, collecting their errors.
+func (p *WorkerPool) runShutdownHooks() {
+	p.hooksMu.Lock()
+	hooks := slices.Clone(p.hooks)
+	p.hooksMu.Unlock()
+
+	var errs []error
+	for _, hook := range slices.Backward(hooks) {
+		if err := hook(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	p.hooksMu.Lock()
+	p.hookErr = errors.Join(errs...)
+	p.hooksMu.Unlock()
+}
+
+// Collect drains the pool like Wait and returns everything it recorded: the
+// completed results and the failed tasks. Because it shuts the pool down
+// first, the two are complete and consistent; calling it again, or after
+// Wait, returns the same values.
+func (p *WorkerPool) Collect() (results []Result, failures []FailedTask) {
+	p.Shutdown(true)
+	return p.Results(), p.Failures()
+}
+
+// Err returns the first FatalError a task hit, or nil. Like errgroup, the
+// first one wins: it cancels the pool context with itself as the cause, so
+// workers stop after their current task and later fatal errors are only
+// recorded as task failures.
+func (p *WorkerPool) Err() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.fatalErr
+}
+
+// fail records err as the pool's fatal error if it is the first, and stops
+// the pool.
+func (p *WorkerPool) fail(err error) {
+	p.fatalOnce.Do(func() {
+		p.mu.Lock()
+		p.fatalErr = err
+		p.mu.Unlock()
+		p.cancel(err)
+	})
+}
+
+// WaitTimeout waits up to d for every worker to exit on its own, e.g. after
+// receiving a termination signal, without closing the queue. If some are
+// still running when d elapses it returns an ErrWaitTimeout saying how many,
+// turning a mismatch between workers and signals into a diagnosable error
+// instead of a hang.
+func (p *WorkerPool) WaitTimeout(d time.Duration) error {
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-p.clock().After(d):
+		return fmt.Errorf("%w: %d still running", ErrWaitTimeout, p.NumWorkers())
+	}
+}
+
+// Results returns a copy of the assignments completed so far. Each result's
+// Metadata is copied too, so callers may change it freely.
+func (p *WorkerPool) Results() []Result {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	results := append([]Result(nil), p.results...)
+	for i := range results {
+		results[i].Metadata = maps.Clone(results[i].Metadata)
+	}
+	return results
+}
+
+// SLAViolations returns the completed assignments whose rider waited longer
+// than threshold from submission to the start of their assignment, in
+// submission order.
+func (p *WorkerPool) SLAViolations(threshold time.Duration) []Result {
+	var late []Result
+	for _, r := range p.SortedResults() {
+		if r.Wait > threshold {
+			late = append(late, r)
+		}
+	}
+	return late
+}
+
+// SortedResults returns a copy of the completed assignments ordered by the
+// sequence in which their tasks were submitted.
+func (p *WorkerPool) SortedResults() []Result {
+	results := p.Results()
+	sort.Slice(results, func(i, j int) bool { return results[i].Seq < results[j].Seq })
+	return results
+}
+
+// resultOutput is the JSON shape of a Result.
+type resultOutput struct {
+	TaskID     string            `json:"task_id"`
+	Rider      string            `json:"rider"`
+	Riders     []string          `json:"riders,omitempty"`
+	Driver     string            `json:"driver"`
+	Rating     float64           `json:"driver_rating,omitempty"`
+	WorkerID   int               `json:"worker_id"`
+	WaitMS     float64           `json:"wait_ms"`
+	DurationMS float64           `json:"duration_ms"`
+	ETAMS      float64           `json:"eta_ms"`
+	Surge      float64           `json:"surge"`
+	Metadata   map[string]string `json:"metadata,omitempty"`
+}
+
+// WriteResultsJSON writes the completed assignments to w as an indented JSON
+// array. Results are ordered by submission so output is stable across runs.
+func (p *WorkerPool) WriteResultsJSON(w io.Writer) error {
+	results := p.SortedResults()
+	out := make([]resultOutput, 0, len(results))
+	for _, r := range results {
+		out = append(out, resultOutput{
+			TaskID:     r.TaskID,
+			Rider:      r.Rider,
+			Riders:     r.Riders,
+			Driver:     r.Driver,
+			Rating:     r.Rating,
+			WorkerID:   r.WorkerID,
+			WaitMS:     float64(r.Wait) / float64(time.Millisecond),
+			DurationMS: float64(r.Duration) / float64(time.Millisecond),
+			ETAMS:      float64(r.ETA) / float64(time.Millisecond),
+			Surge:      r.Surge,
+			Metadata:   r.Metadata,
+		})
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(out)
+}
+
+// WriteResultsCSV writes the completed assignments to w as CSV, with a
+// header row followed by one row per result in submission order. Fields
+// containing commas or quotes are quoted per RFC 4180.
+func (p *WorkerPool) WriteResultsCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"rider", "driver", "worker_id", "duration_ms", "started_at"}); err != nil {
+		return err
+	}
+	for _, r := range p.SortedResults() {
+		err := cw.Write([]string{
+			r.Rider,
+			r.Driver,
+			strconv.Itoa(r.WorkerID),
+			strconv.FormatFloat(float64(r.Duration)/float64(time.Millisecond), 'f', 3, 64),
+			r.StartedAt.UTC().Format(time.RFC3339Nano),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// failedTaskOutput is the JSON shape of a FailedTask, as written by
+// WriteFailedTasks and read back by LoadFailedTasks.
+type failedTaskOutput struct {
+	ID        string            `json:"id"`
+	Rider     string            `json:"rider"`
+	Riders    []string          `json:"riders,omitempty"`
+	Driver    string            `json:"driver"`
+	Priority  int               `json:"priority"`
+	RiderLat  float64           `json:"rider_lat"`
+	RiderLng  float64           `json:"rider_lng"`
+	DriverLat float64           `json:"driver_lat"`
+	DriverLng float64           `json:"driver_lng"`
+	Retries   int               `json:"retries"`
+	WorkerID  int               `json:"worker_id"`
+	Error     string            `json:"error"`
+	Reason    string            `json:"reason"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+}
+
+// WriteFailedTasks writes the recorded failures to w as an indented JSON
+// array, so they can be reloaded with LoadFailedTasks and retried later.
+func (p *WorkerPool) WriteFailedTasks(w io.Writer) error {
+	failures := p.Failures()
+	out := make([]failedTaskOutput, 0, len(failures))
+	for _, f := range failures {
+		out = append(out, failedTaskOutput{
+			ID:        f.Task.ID,
+			Rider:     f.Task.Rider,
+			Riders:    f.Task.Riders,
+			Driver:    f.Task.Driver,
+			Priority:  f.Task.Priority,
+			RiderLat:  f.Task.RiderLat,
+			RiderLng:  f.Task.RiderLng,
+			DriverLat: f.Task.DriverLat,
+			DriverLng: f.Task.DriverLng,
+			Retries:   f.Task.Retries,
+			WorkerID:  f.WorkerID,
+			Error:     f.Err.Error(),
+			Reason:    f.Reason.String(),
+			Metadata:  f.Task.Metadata,
+		})
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(out)
+}
+
+// LoadFailedTasks reads a dump written by WriteFailedTasks back into tasks
+// ready to resubmit, keeping each task's ID and retry count, so a task that
+// already used up MaxRetries fails on its first error rather than being
+// retried again. Deadlines and start times are not persisted, since they
+// will usually have passed by the time the tasks are replayed. It returns an
+// error wrapping ErrInvalidTask if a record has no rider or driver.
+func LoadFailedTasks(r io.Reader) ([]Task, error) {
+	var in []failedTaskOutput
+	if err := json.NewDecoder(r).Decode(&in); err != nil {
+		return nil, fmt.Errorf("decoding failed tasks: %w", err)
+	}
+
+	tasks := make([]Task, 0, len(in))
+	for i, f := range in {
+		task := NewTaskWithID(f.ID, f.Rider, f.Driver)
+		task.Riders = f.Riders
+		task.Priority = f.Priority
+		task.RiderLat, task.RiderLng = f.RiderLat, f.RiderLng
+		task.DriverLat, task.DriverLng = f.DriverLat, f.DriverLng
+		task.Retries = f.Retries
+		task.Metadata = f.Metadata
+		if err := validateFields(task); err != nil {
+			return nil, fmt.Errorf("failed task %d (%s): %w", i, f.ID, err)
+		}
+		tasks = append(tasks, task)
+	}
+	return tasks, nil
+}
+
+// Handler returns an HTTP handler exposing the pool as a small service:
+//
+//	POST /tasks   submits {"rider": ..., "driver": ...} and replies with the task ID
+//	GET  /results returns the completed assignments, as WriteResultsJSON does
+//	GET  /metrics serves MetricsHandler
+//	GET  /healthz serves HealthHandler
+func (p *WorkerPool) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /tasks", p.handleSubmit)
+	mux.HandleFunc("GET /results", p.handleResults)
+	mux.Handle("GET /metrics", p.MetricsHandler())
+	mux.Handle("GET /healthz", p.HealthHandler())
+	return mux
+}
+
+// handleSubmit decodes a single task from the request body and submits it.
+func (p *WorkerPool) handleSubmit(w http.ResponseWriter, r *http.Request) {
+	var in taskInput
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		http.Error(w, fmt.Sprintf("decoding task: %v", err), http.StatusBadRequest)
+		return
+	}
+	task, err := in.task()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := p.Submit(task); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"id": task.ID})
+}
+
+// handleResults writes the completed assignments as JSON.
+func (p *WorkerPool) handleResults(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := p.WriteResultsJSON(w); err != nil {
+		p.logger.Error("writing results", "event", "http", "error", err)
+	}
+}
+
+// Serve runs Handler on addr until ctx is cancelled, then stops the server
+// and drains the pool so every accepted task is still assigned. The pool
+// must already be started.
+func (p *WorkerPool) Serve(ctx context.Context, addr string) error {
+	srv := &http.Server{Addr: addr, Handler: p.Handler()}
+
+	errc := make(chan error, 1)
+	go func() { errc <- srv.ListenAndServe() }()
+
+	select {
+	case err := <-errc:
+		p.Shutdown(true)
+		return err
+	case <-ctx.Done():
+	}
+
+	// Stop accepting requests first so nothing is submitted mid-drain
+	err := srv.Shutdown(context.Background())
+	p.Shutdown(true)
+	return err
+}
+
+// MetricsHandler serves the pool's counters in the Prometheus text exposition
+// format. The values come straight from the atomic counters the workers
+// update, so a scrape never races a worker.
+func (p *WorkerPool) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		m := p.Metrics()
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		fmt.Fprintf(w, "# HELP tasks_processed_total Tasks assigned successfully.\n")
+		fmt.Fprintf(w, "# TYPE tasks_processed_total counter\n")
+		fmt.Fprintf(w, "tasks_processed_total %d\n", m.Completed)
+		fmt.Fprintf(w, "# HELP tasks_failed_total Tasks recorded as failed after exhausting retries.\n")
+		fmt.Fprintf(w, "# TYPE tasks_failed_total counter\n")
+		fmt.Fprintf(w, "tasks_failed_total %d\n", m.Failed)
+		fmt.Fprintf(w, "# HELP tasks_in_flight Tasks currently held by a worker.\n")
+		fmt.Fprintf(w, "# TYPE tasks_in_flight gauge\n")
+		fmt.Fprintf(w, "tasks_in_flight %d\n", m.InFlight)
+		fmt.Fprintf(w, "# HELP task_duration_seconds Processing time of completed tasks.\n")
+		fmt.Fprintf(w, "# TYPE task_duration_seconds summary\n")
+		for _, q := range []float64{50, 95, 99} {
+			fmt.Fprintf(w, "task_duration_seconds{quantile=\"%g\"} %g\n", q/100, p.LatencyPercentile(q).Seconds())
+		}
+	})
+}
+
+// Metrics returns a snapshot of the pool's counters. It is safe to call from
+// any goroutine while the pool is running.
+func (p *WorkerPool) Metrics() Metrics {
+	return Metrics{
+		Submitted: p.submitted.Load(),
+		Completed: p.completed.Load(),
+		Failed:    p.failed.Load(),
+		Cancelled: p.cancelledCount.Load(),
+		Expired:   p.expiredCount.Load(),
+		InFlight:  p.inFlight.Load(),
+	}
+}
+
+// LatencyPercentile returns the processing duration that the given
+// percentage pct of completed tasks finished within (e.g. 99 for p99), using
+// the nearest-rank method over every completion so far, or the most recent
+// MaxRetainedResults of them when that is set. pct is clamped to [0, 100];
+// the result is zero before any task completes.
+func (p *WorkerPool) LatencyPercentile(pct float64) time.Duration {
+	p.mu.Lock()
+	sorted := slices.Clone(p.latencies)
+	p.mu.Unlock()
+	if len(sorted) == 0 {
+		return 0
+	}
+	slices.Sort(sorted)
+
+	rank := int(math.Ceil(min(max(pct, 0), 100) / 100 * float64(len(sorted))))
+	return sorted[max(rank-1, 0)]
+}
+
+// Processed returns how many submitted tasks have finished, however they
+// ended: completed, failed, cancelled or expired.
+func (m Metrics) Processed() int64 {
+	return m.Completed + m.Failed + m.Cancelled + m.Expired
+}
+
+// Progress returns the fraction of submitted tasks that have finished, from
+// 0 to 1, for driving a progress bar. Termination signals are not counted.
+// It is 0 before anything is submitted.
+func (p *WorkerPool) Progress() float64 {
+	m := p.Metrics()
+	if m.Submitted == 0 {
+		return 0
+	}
+	return float64(m.Processed()) / float64(m.Submitted)
+}
+
+// RunSummary is an end-of-run report for a pool.
+type RunSummary struct {
+	Total          int64         // Tasks submitted
+	Succeeded      int64         // Tasks assigned successfully
+	Failed         int64         // Tasks recorded as failures
+	Cancelled      int64         // Tasks cancelled
+	Expired        int64         // Tasks skipped past their deadline
+	Duration       time.Duration // From Start until the pool finished, or until now while it runs
+	TasksPerSecond float64       // Finished tasks, however they ended, per second of Duration
+	WorkerTasks    map[int]int   // Tasks handled by each worker, as WorkerTaskCounts
+}
+
+// Summary reports the pool's run so far: how many tasks it took and how
+// they ended, how long it has run, its throughput and each worker's share.
+// Called after Wait it describes the whole run.
+func (p *WorkerPool) Summary() RunSummary {
+	m := p.Metrics()
+	p.mu.Lock()
+	var elapsed time.Duration
+	switch {
+	case p.startedAt.IsZero():
+	case p.finishedAt.IsZero():
+		elapsed = p.clock().Now().Sub(p.startedAt)
+	default:
+		elapsed = p.finishedAt.Sub(p.startedAt)
+	}
+	p.mu.Unlock()
+
+	s := RunSummary{
+		Total:       m.Submitted,
+		Succeeded:   m.Completed,
+		Failed:      m.Failed,
+		Cancelled:   m.Cancelled,
+		Expired:     m.Expired,
+		Duration:    elapsed,
+		WorkerTasks: p.WorkerTaskCounts(),
+	}
+	if elapsed > 0 {
+		s.TasksPerSecond = float64(m.Processed()) / elapsed.Seconds()
+	}
+	return s
+}
+
+// String formats the summary as a short multi-line report, with workers in
+// ID order.
+func (s RunSummary) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Run summary:\n")
+	fmt.Fprintf(&b, "  tasks:      %d (%d succeeded, %d failed, %d cancelled, %d expired)\n",
+		s.Total, s.Succeeded, s.Failed, s.Cancelled, s.Expired)
+	fmt.Fprintf(&b, "  duration:   %s (%.1f tasks/sec)\n", s.Duration.Round(time.Millisecond), s.TasksPerSecond)
+	for _, id := range slices.Sorted(maps.Keys(s.WorkerTasks)) {
+		fmt.Fprintf(&b, "  worker %-3d  %d tasks\n", id, s.WorkerTasks[id])
+	}
+	return b.String()
+}
+
+// CancelTask cancels the task with the given ID. A task still waiting in the
+// queue is removed; a running task is aborted through its context. It
+// returns false if no queued or running task has that ID. Cancelled tasks are
+// reported by Cancelled rather than as results or failures.
+func (p *WorkerPool) CancelTask(id string) bool {
+	if task, ok := p.tasks.remove(id); ok {
+		p.recordCancelled(task)
+		return true
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if cancel, ok := p.running[id]; ok {
+		cancel(ErrTaskCancelled)
+		return true
+	}
+	return false
+}
+
+// CancelAll cancels every queued and running task, recording each as
+// cancelled, but unlike Shutdown leaves the pool running: tasks submitted
+// afterwards are processed as normal. Running tasks are aborted through
+// their context and stop as soon as their processor notices. Tasks
+// submitted concurrently with CancelAll may land on either side of it. It
+// returns how many tasks were cancelled from the queue; running ones are
+// counted by Cancelled once they stop.
+func (p *WorkerPool) CancelAll() int {
+	// Start a new generation first, so a task popped while the queue is
+	// being cleared is seen as stale before it can start
+	p.mu.Lock()
+	p.generation.Add(1)
+	p.genCancel(ErrTaskCancelled)
+	p.genCtx, p.genCancel = context.WithCancelCause(p.parent)
+	p.mu.Unlock()
+
+	tasks := p.tasks.clear()
+	for _, task := range tasks {
+		p.recordCancelled(task)
+	}
+	p.logger.Info("cancelled all tasks", "event", "cancel_all", "queued", len(tasks))
+	return len(tasks)
+}
+
+// Snapshot takes every task still waiting in the queue, including scheduled
+// tasks and retries, out of the pool and returns them in submission order,
+// for persisting before a restart and handing to Restore. The queue is
+// emptied under its lock, so each task is either in the snapshot or already
+// started, never both or neither. The pool keeps running: tasks in flight
+// finish here, and snapshotted ones no longer count as submitted. It
+// returns an error if the pool uses a Queue backend, whose tasks are the
+// backend's to persist.
+func (p *WorkerPool) Snapshot() ([]Task, error) {
+	if p.backend != nil {
+		return nil, errors.New("snapshot: pool uses a Queue backend")
+	}
+
+	tasks := p.tasks.clear()
+	sort.Slice(tasks, func(i, j int) bool { return tasks[i].Seq < tasks[j].Seq })
+	for i, task := range tasks {
+		p.submitted.Add(-1)
+		p.recordEvent(EventSnapshot, task.ID, 0, nil)
+		if p.Dedupe {
+			p.releaseKey(task)
+		}
+		p.settle(task, nil)
+		tasks[i].stream = nil // Settled here; a restored copy belongs to no stream
+	}
+	p.logger.Info("snapshotted queue", "event", "snapshot", "tasks", len(tasks))
+	return tasks, nil
+}
+
+// Restore submits tasks taken by Snapshot, usually from another pool, keeping
+// their IDs, priorities, schedules, retry counts and submission times, so
+// waits keep counting from the original Submit. It blocks for room as
+// Submit does and returns the first error, naming the task that could not
+// be queued; the tasks before it were queued.
+func (p *WorkerPool) Restore(tasks []Task) error {
+	for i, task := range tasks {
+		if err := p.Submit(task); err != nil {
+			return fmt.Errorf("restoring task %d (%s): %w", i, task.ID, err)
+		}
+	}
+	return nil
+}
+
+// Reset clears the results, failures, cancellations, expiries, panics,
+// audit log, task statuses, dedupe keys, counters and worker statistics,
+// so a running pool can take another independent batch without being
+// rebuilt. Workers stay alive and idle, and driver breakers keep their
+// state, since they describe the drivers rather than the batch. Submit
+// waits while Reset runs. Reset returns ErrPoolBusy, changing nothing, if
+// any task is still queued or in flight, and ErrPoolClosed once the pool
+// has shut down.
+func (p *WorkerPool) Reset() error {
+	p.resetMu.Lock()
+	defer p.resetMu.Unlock()
+	if p.closed.Load() {
+		return ErrPoolClosed
+	}
+	if !p.tasks.idle() || (p.backend != nil && p.backend.Len() > 0) || p.inFlight.Load() > 0 {
+		return ErrPoolBusy
+	}
+
+	now := p.clock().Now()
+	p.mu.Lock()
+	p.results, p.latencies, p.failures = nil, nil, nil
+	p.cancelled, p.expired, p.panics = nil, nil, nil
+	p.startedAt, p.finishedAt = now, time.Time{}
+	p.mu.Unlock()
+
+	p.eventsMu.Lock()
+	p.events = nil
+	p.eventsMu.Unlock()
+	p.store.clear()
+
+	p.seenMu.Lock()
+	clear(p.seenKeys)
+	p.seenMu.Unlock()
+
+	p.workersMu.Lock()
+	for id, rec := range p.stats {
+		// A removed worker may still be exiting and will touch its record, so
+		// only drop the records of workers that have already stopped.
+		if !rec.stopped.IsZero() {
+			delete(p.stats, id)
+			continue
+		}
+		rec.stats, rec.started = WorkerStats{WorkerID: id}, now
+	}
+	p.workersMu.Unlock()
+
+	p.submitted.Store(0)
+	p.completed.Store(0)
+	p.failed.Store(0)
+	p.cancelledCount.Store(0)
+	p.expiredCount.Store(0)
+	p.dropped.Store(0)
+	p.logger.Info("pool reset", "event", "reset")
+	return nil
+}
+
+// Cancelled returns the tasks cancelled so far.
+func (p *WorkerPool) Cancelled() []Task {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]Task(nil), p.cancelled...)
+}
+
+// recordCancelled stores a task stopped by CancelTask or CancelAll.
+func (p *WorkerPool) recordCancelled(task Task) {
+	p.recordEvent(EventCancel, task.ID, 0, nil)
+	p.mu.Lock()
+	p.cancelled = append(p.cancelled, task)
+	p.mu.Unlock()
+	p.cancelledCount.Add(1)
+	p.settle(task, nil)
+}
+
+// Panics returns every panic recovered from Process so far, including the
+// stack trace at the point of the panic.
+func (p *WorkerPool) Panics() []PanicRecord {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]PanicRecord(nil), p.panics...)
+}
+
+// Expired returns the tasks that were skipped because their deadline had
+// passed or they had waited in the queue past MaxQueueWait.
+func (p *WorkerPool) Expired() []Task {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]Task(nil), p.expired...)
+}
+
+// recordExpired stores a task that was skipped because its deadline had passed.
+func (p *WorkerPool) recordExpired(task Task) {
+	p.recordEvent(EventExpire, task.ID, 0, nil)
+	p.mu.Lock()
+	p.expired = append(p.expired, task)
+	p.mu.Unlock()
+	p.expiredCount.Add(1)
+	p.settle(task, nil)
+}
+
+// recordEvent appends an entry to the audit log.
+func (p *WorkerPool) recordEvent(typ EventType, taskID string, workerID int, err error) {
+	if status, ok := eventStatuses[typ]; ok {
+		p.store.Set(taskID, status)
+	} else if typ == EventDrop || typ == EventSnapshot {
+		p.store.Delete(taskID) // Never queued after all, or no longer this pool's
+	}
+
+	p.eventsMu.Lock()
+	defer p.eventsMu.Unlock()
+	p.events = append(p.events, Event{Time: p.clock().Now(), Type: typ, TaskID: taskID, WorkerID: workerID, Err: err})
+}
+
+// Events returns a copy of the audit log in the order events happened.
+func (p *WorkerPool) Events() []Event {
+	p.eventsMu.Lock()
+	defer p.eventsMu.Unlock()
+	return append([]Event(nil), p.events...)
+}
+
+// Errors returns a channel that receives a TaskError for every task recorded
+// as failed, whether it panicked, timed out or returned an error. The
+// channel is closed once the pool has shut down and every error has been
+// delivered, so consumers can simply range over it. Failures are buffered
+// without limit by a collector goroutine, so a slow consumer never blocks
+// workers. Only failures recorded after the first call are delivered; call it
+// before Start to see them all.
+func (p *WorkerPool) Errors() <-chan TaskError {
+	p.errOnce.Do(func() {
+		p.errOut = make(chan TaskError)
+
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		select {
+		case <-p.finished:
+			close(p.errOut) // Nothing more can fail
+		default:
+			p.errIn = make(chan TaskError)
+			go collectErrors(p.errIn, p.errOut)
+		}
+	})
+	return p.errOut
+}
+
+// collectErrors forwards errors from in to out, queuing them in between so
+// senders never wait on the consumer. It closes out after in is closed and
+// everything queued has been delivered.
+func collectErrors(in <-chan TaskError, out chan<- TaskError) {
+	defer close(out)
+
+	var pending []TaskError
+	for in != nil || len(pending) > 0 {
+		var send chan<- TaskError // nil, and so never ready, while nothing is pending
+		var next TaskError
+		if len(pending) > 0 {
+			send, next = out, pending[0]
+		}
+
+		select {
+		case te, ok := <-in:
+			if !ok {
+				in = nil
+				continue
+			}
+			pending = append(pending, te)
+		case send <- next:
+			pending = pending[1:]
+		}
+	}
+}
+
+// Status returns the current status of the task with the given ID, and
+// false if the pool has never accepted a task with that ID.
+func (p *WorkerPool) Status(id string) (TaskStatus, bool) {
+	return p.store.Get(id)
+}
+
+// Failures returns the tasks that failed so far, with their Metadata
+// copied as Results does.
+func (p *WorkerPool) Failures() []FailedTask {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	failures := append([]FailedTask(nil), p.failures...)
+	for i := range failures {
+		failures[i].Task.Metadata = maps.Clone(failures[i].Task.Metadata)
+	}
+	return failures
+}
+
+// FailuresByReason counts every task that did not complete by reason:
+// failures by their recorded Reason, plus expired tasks as FailureExpired
+// and cancelled ones as FailureCancelled. Reasons with no tasks are absent.
+func (p *WorkerPool) FailuresByReason() map[FailureReason]int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	counts := make(map[FailureReason]int)
+	for _, f := range p.failures {
+		counts[f.Reason]++
+	}
+	if len(p.expired) > 0 {
+		counts[FailureExpired] += len(p.expired)
+	}
+	if len(p.cancelled) > 0 {
+		counts[FailureCancelled] += len(p.cancelled)
+	}
+	return counts
+}
+
+// processOutcome carries a processor's return values back to the worker.
+type processOutcome struct {
+	result Result
+	err    error
+}
+
+// driverHold keeps a task's driver booked until the worker and any Process
+// call it gave up on have both finished with the task, so an abandoned call
+// that goes on to make its assignment never overlaps another task for the
+// same driver.
+type driverHold struct {
+	refs    atomic.Int32
+	release func()
+}
+
+// holdDriver returns a hold on driver, which the caller has acquired, with
+// one reference for the worker.
+func (p *WorkerPool) holdDriver(driver string) *driverHold {
+	h := &driverHold{release: func() { p.releaseDriver(driver) }}
+	h.refs.Store(1)
+	return h
+}
+
+// add takes another reference on the hold.
+func (h *driverHold) add() {
+	h.refs.Add(1)
+}
+
+// done drops a reference, releasing the driver with the last one.
+func (h *driverHold) done() {
+	if h.refs.Add(-1) == 0 {
+		h.release()
+	}
+}
+
+// dryRun stands in for runTask when DryRun is set.
+func (p *WorkerPool) dryRun(logger *slog.Logger, task Task) (Result, error) {
+	if err := validateTask(task, p.clock().Now()); err != nil {
+		logger.Warn("dry run: invalid task", "event", "dry_run", "error", err)
+		return Result{}, err
+	}
+	logger.Info("dry run: would assign", "event", "dry_run", "riders", task.AllRiders(), "eta", task.ETA())
+	return Result{Rider: task.Rider, Riders: slices.Clone(task.Riders), Driver: task.Driver, ETA: task.ETA()}, nil
+}
+
+// jitter returns the next random delay in [0, StartJitter), or zero if
+// StartJitter is not set.
+func (p *WorkerPool) jitter() time.Duration {
+	if p.jitterRNG == nil {
+		return 0
+	}
+	p.jitterMu.Lock()
+	defer p.jitterMu.Unlock()
+	return time.Duration(p.jitterRNG.Int64N(int64(p.StartJitter)))
+}
+
+// runTask runs the pool's processor in its own goroutine, after any
+// StartJitter delay and once a MaxConcurrent slot is free, and returns its
+// result. Unless PanicPolicy is PanicPropagate, a panic is recovered as a
+// last-resort safety net and reported as an error, and the call is given up
+// on once TaskTimeout elapses or ctx is cancelled. An abandoned Process
+// keeps running in the background, but its outcome is discarded; it keeps
+// its slot and, through hold, the task's driver until it returns.
+func (p *WorkerPool) runTask(ctx context.Context, logger *slog.Logger, task Task, hold *driverHold) (Result, error) {
+	if d := p.jitter(); d > 0 {
+		if err := sleepContext(ctx, p.clock(), d); err != nil {
+			return Result{}, err
+		}
+	}
+	if p.slots != nil {
+		select {
+		case p.slots <- struct{}{}:
+		case <-ctx.Done():
+			return Result{}, context.Cause(ctx)
+		}
+	}
+	done := make(chan processOutcome, 1) // Buffered so an abandoned Process never blocks
+
+	hold.add()
+	go func() {
+		var out processOutcome
+		defer func() {
+			// Recover only from true panics; ordinary failures are returned errors
+			if r := recover(); r != nil {
+				if p.PanicPolicy == PanicPropagate {
+					// Still inside the deferred call, so the panicking frames
+					// remain on the stack and the crash report shows them
+					logger.Error("panic in task, crashing", "event", "panic", "panic", r)
+					panic(r)
+				}
+				out = processOutcome{err: &panicError{value: r, stack: string(debug.Stack())}}
+			}
+			// Held until Process really returns, even if it was abandoned,
+			// and let go before reporting so the next task finds them free
+			if p.slots != nil {
+				<-p.slots
+			}
+			hold.done()
+			done <- out
+		}()
+		out.result, out.err = p.processor.Process(ctx, logger, task)
+	}()
+
+	var timeout <-chan time.Time // nil, and so never ready, without a TaskTimeout
+	if p.TaskTimeout > 0 {
+		timeout = p.clock().After(p.TaskTimeout)
+	}
+
+	select {
+	case out := <-done:
+		return out.result, out.err
+	case <-timeout:
+		return Result{}, ErrTaskTimeout
+	case <-ctx.Done():
+		return Result{}, context.Cause(ctx)
+	}
+}
+
+// clock returns the pool's Clock, defaulting to RealClock.
+func (p *WorkerPool) clock() Clock {
+	if p.Clock == nil {
+		return RealClock{}
+	}
+	return p.Clock
+}
+
+// backoff returns the delay before retry number attempt (starting at zero).
+func (p *WorkerPool) backoff(attempt int) time.Duration {
+	return p.RetryBackoff * time.Duration(1<<attempt)
+}
+
+// retryOrFail re-enqueues a failed task to start after an exponential
+// backoff, or records it as a failure once MaxRetries is exhausted,
+// RetryPolicy rejects the error, or the pool is cancelled. The backoff is
+// waited out in the queue, so the worker is free to run other tasks.
+func (p *WorkerPool) retryOrFail(id int, task Task, err error) {
+	logger := p.taskLogger(id, task)
+	retryable := p.RetryPolicy == nil || p.RetryPolicy(err)
+	if !retryable {
+		logger.Info("error not retryable", "event", "no_retry", "error", err)
+	}
+	if retryable && task.Retries < p.MaxRetries && p.ctx.Err() == nil {
+		p.traceError(task.ID, err)
+		delay := p.backoff(task.Retries)
+		logger.Info("retrying task", "event", "retry", "delay", delay, "attempt", task.Retries+1, "max_retries", p.MaxRetries)
+
+		task.Retries++
+		if delay > 0 {
+			task.StartAfter = p.clock().Now().Add(delay)
+		}
+		p.store.Set(task.ID, StatusQueued)
+		if dropped, ok := p.tasks.retry(task); ok {
+			p.taskLogger(0, dropped).Warn("retry queue full, dropping oldest retry", "event", "retry_dropped")
+			p.recordFailure(0, dropped, ErrRetryDropped)
+		}
+		return
+	}
+
+	p.recordFailure(id, task, err)
+}
+
+// confirm asks the Acceptor whether the proposal's driver accepts it,
+// treating no answer within AcceptTimeout as a rejection.
+func (p *WorkerPool) confirm(proposal Result) bool {
+	p.mu.Lock()
+	ctx := p.genCtx // So CancelAll withdraws the proposal too
+	p.mu.Unlock()
+	if p.AcceptTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.AcceptTimeout)
+		defer cancel()
+	}
+
+	answer := make(chan bool, 1) // Buffered so a late answer never blocks
+	go func() { answer <- p.Acceptor.Accept(ctx, proposal) }()
+	select {
+	case ok := <-answer:
+		return ok && ctx.Err() == nil
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// reassign offers a rejected task to its next candidate driver by
+// requeueing it, or records it as failed if no candidates remain.
+func (p *WorkerPool) reassign(id int, task Task) {
+	logger := p.taskLogger(id, task)
+	if len(task.Candidates) == 0 {
+		logger.Warn("assignment rejected, no drivers left", "event", "rejected")
+		p.recordFailure(id, task, ErrAssignmentRejected)
+		return
+	}
+
+	i := 0
+	if p.Strategy != nil {
+		rider := Rider{Name: task.Rider, Location: Location{Lat: task.RiderLat, Lng: task.RiderLng}}
+		d, ok := p.Strategy.Select(rider, task.Candidates)
+		if i = slices.Index(task.Candidates, d); !ok || i < 0 {
+			logger.Warn("assignment rejected, no acceptable drivers left", "event", "rejected")
+			p.recordFailure(id, task, ErrAssignmentRejected)
+			return
+		}
+	}
+	next := task.Candidates[i]
+	task.Candidates = slices.Delete(slices.Clone(task.Candidates), i, i+1)
+	logger.Info("assignment rejected, offering to next driver", "event", "rejected", "next_driver", next.Name)
+	task.Driver = next.Name
+	task.DriverLat, task.DriverLng = next.Location.Lat, next.Location.Lng
+	task.DriverRating = next.Rating
+	p.store.Set(task.ID, StatusQueued)
+	p.tasks.requeue(task)
+}
+
+// recordFailure stores a task that will not be attempted again.
+func (p *WorkerPool) recordFailure(id int, task Task, err error) {
+	p.traceError(task.ID, err)
+	p.recordEvent(EventFail, task.ID, id, err)
+	p.mu.Lock()
+	p.failures = append(p.failures, FailedTask{Task: task, WorkerID: id, Err: err, Reason: failureReason(err)})
+	if p.errIn != nil {
+		p.errIn <- TaskError{Task: task, Err: err} // The collector is always ready to receive
+	}
+	p.mu.Unlock()
+	p.failed.Add(1)
+	p.workersMu.Lock()
+	if rec, ok := p.stats[id]; ok {
+		rec.stats.Failures++
+	}
+	p.workersMu.Unlock()
+
+	if p.OnError != nil {
+		p.serialized(func() { p.OnError(task, err) })
+	}
+	p.settle(task, nil)
+}
+
+// serialized runs a user callback while holding callbackMu.
+func (p *WorkerPool) serialized(fn func()) {
+	p.callbackMu.Lock()
+	defer p.callbackMu.Unlock()
+	fn()
+}
+
+// waitForRateLimit blocks until the pool's rate limiter allows another
+// Process call. It returns false if the pool is cancelled while waiting.
+func (p *WorkerPool) waitForRateLimit() bool {
+	if p.rateTicker == nil {
+		return true
+	}
+	select {
+	case <-p.rateTicker.C:
+		return true
+	case <-p.ctx.Done():
+		return false
+	}
+}
+
+// worker is a goroutine that retrieves the highest-priority task from the queue and processes it.
+// It writes results to the shared slice safely using the pool's mutex.
+// h.ctx is the worker's own context, derived from the pool's, so that
+// RemoveWorkers can stop it individually.
+func (p *WorkerPool) worker(id int, h *workerHandle) {
+	defer p.wg.Done() // Decrement the WaitGroup counter when the worker exits
+	defer p.forgetWorker(id)
+	defer close(h.exited)
+
+	ctx := h.ctx
+	logger := p.logger.With("worker_id", id)
+
+	for {
+		// Wait for either a task or cancellation of the worker's context
+		task, ok := p.nextTask(h)
+
+		// Never start new work once the context is done
+		if p.ctx.Err() != nil {
+			logger.Info("stopping due to cancellation", "event", "stop", "cause", context.Cause(p.ctx))
+			return
+		}
+		if ctx.Err() != nil {
+			if ok {
+				// Removed just as a task arrived; hand it to another worker
+				p.tasks.requeue(task)
+				p.tasks.done()
+			}
+			logger.Info("removed from pool", "event", "stop")
+			return
+		}
+
+		if !ok {
+			logger.Info("task queue closed", "event", "stop")
+			return
+		}
+
+		// Stop processing if the termination signal is received
+		if task.IsTerminationSignal {
+			logger.Info("received termination signal", "event", "stop")
+			p.tasks.done()
+			return
+		}
+
+		p.heartbeat(id, h, true)
+		p.traceTask(id, task)
+		p.heartbeat(id, h, false)
+		p.tasks.done()
+		p.touch()
+	}
+}
+
+// pump moves tasks from the queue backend into the pool's buffer as room
+// frees up, closing the buffer once the backend is closed and drained, or
+// the pool is cancelled.
+func (p *WorkerPool) pump() {
+	defer p.wg.Done()
+	defer p.tasks.close()
+
+	for {
+		task, ok := p.backend.Dequeue(p.ctx)
+		if !ok {
+			return
+		}
+		if err := p.tasks.push(p.ctx, task, QueueBlock); err != nil {
+			// Only possible once the pool is cancelled, which abandons
+			// queued tasks anyway
+			p.logger.Warn("pool not accepting tasks, dropping task", "event", "drop",
+				"task_id", task.ID, "rider", task.Rider, "driver", task.Driver, "error", err)
+			return
+		}
+	}
+}
+
+// queueLen returns how many tasks are waiting, in the backend and the buffer.
+func (p *WorkerPool) queueLen() int {
+	n := p.tasks.len()
+	if p.backend != nil {
+		n += p.backend.Len()
+	}
+	return n
+}
+
+// nextTask blocks until the worker has a task: popped from the shared queue,
+// or handed over by the dispatcher in RoundRobin or RiderAffinity mode. It
+// returns false when there is no more work or the worker's context is
+// cancelled.
+func (p *WorkerPool) nextTask(h *workerHandle) (Task, bool) {
+	if h.inbox == nil {
+		return p.tasks.pop(h.ctx)
+	}
+
+	select {
+	case task := <-h.inbox:
+		return task, true
+	case <-h.ctx.Done():
+		return Task{}, false
+	case <-p.dispatched:
+		return Task{}, false
+	}
+}
+
+// heartbeat records that worker id, behind h, is starting (busy) or has
+// finished a task, adding the time the task took to its busy time.
+func (p *WorkerPool) heartbeat(id int, h *workerHandle, busy bool) {
+	now := p.clock().Now()
+	p.workersMu.Lock()
+	defer p.workersMu.Unlock()
+	h.lastBeat = now
+	if busy {
+		h.busySince = now
+	} else {
+		p.stats[id].stats.Busy += now.Sub(h.busySince)
+		h.busySince = time.Time{}
+	}
+}
+
+// minStuckCheckInterval bounds how often the stuck monitor checks, however
+// small StuckThreshold is.
+const minStuckCheckInterval = time.Millisecond
+
+// monitorStuck checks worker heartbeats every half StuckThreshold, timed by
+// the pool's Clock, until the pool shuts down.
+func (p *WorkerPool) monitorStuck() {
+	defer p.reporters.Done()
+	interval := max(p.StuckThreshold/2, minStuckCheckInterval)
+
+	for {
+		select {
+		case <-p.clock().After(interval):
+			p.checkStuck()
+		case <-p.finished:
+			return
+		}
+	}
+}
+
+// checkStuck records which workers are stuck, logging each one that has
+// become stuck since the last check.
+func (p *WorkerPool) checkStuck() {
+	now := p.clock().Now()
+	p.workersMu.Lock()
+	defer p.workersMu.Unlock()
+
+	prev := p.stuck
+	p.stuck = nil
+	for id, h := range p.workers {
+		if h.busySince.IsZero() || now.Sub(h.busySince) <= p.StuckThreshold {
+			continue
+		}
+		p.stuck = append(p.stuck, id)
+		if !slices.Contains(prev, id) {
+			p.logger.Warn("worker stuck", "event", "stuck", "worker_id", id,
+				"running_for", now.Sub(h.busySince), "last_heartbeat", h.lastBeat)
+		}
+	}
+	slices.Sort(p.stuck)
+}
+
+// monitorIdle shuts the pool down once IdleTimeout passes without activity
+// while nothing is queued or running.
+func (p *WorkerPool) monitorIdle() {
+	defer p.reporters.Done()
+
+	for {
+		select {
+		case <-p.activity:
+		case <-p.clock().After(p.IdleTimeout):
+			if p.queueLen() > 0 || p.inFlight.Load() > 0 {
+				continue
+			}
+			p.logger.Info("pool idle, shutting down", "event", "idle_shutdown", "idle_timeout", p.IdleTimeout)
+			// Shutdown waits for reporters, this one included, so it must
+			// run elsewhere
+			go p.Shutdown(true)
+			return
+		case <-p.finished:
+			return
+		}
+	}
+}
+
+// touch records activity for the idle monitor.
+func (p *WorkerPool) touch() {
+	select {
+	case p.activity <- struct{}{}:
+	default: // A nudge is already pending
+	}
+}
+
+// StuckWorkers returns the IDs of the workers whose current task had run
+// longer than StuckThreshold at the monitor's last check, in ascending order.
+func (p *WorkerPool) StuckWorkers() []int {
+	p.workersMu.Lock()
+	defer p.workersMu.Unlock()
+	return slices.Clone(p.stuck)
+}
+
+// Health checks whether the pool can take and make progress on work: it has
+// been neither shut down nor cancelled, at least one worker is alive, the
+// buffer is not full, and no worker has been busy on one task for longer
+// than StuckThreshold. Stuck workers are judged from their heartbeats at the
+// time of the call rather than at the monitor's last check.
+func (p *WorkerPool) Health() HealthStatus {
+	status := HealthStatus{QueueDepth: p.queueLen()}
+	now := p.clock().Now()
+
+	p.workersMu.Lock()
+	status.Workers = len(p.workers)
+	if p.StuckThreshold > 0 {
+		for id, h := range p.workers {
+			if !h.busySince.IsZero() && now.Sub(h.busySince) > p.StuckThreshold {
+				status.Stuck = append(status.Stuck, id)
+			}
+		}
+	}
+	p.workersMu.Unlock()
+	slices.Sort(status.Stuck)
+
+	if p.closed.Load() {
+		status.Problems = append(status.Problems, "pool shut down")
+	}
+	if p.ctx.Err() != nil {
+		status.Problems = append(status.Problems, "pool cancelled")
+	}
+	if status.Workers == 0 {
+		status.Problems = append(status.Problems, "no workers running")
+	}
+	if p.tasks.full() {
+		status.Problems = append(status.Problems, "queue full")
+	}
+	if len(status.Stuck) > 0 {
+		status.Problems = append(status.Problems, fmt.Sprintf("workers stuck: %v", status.Stuck))
+	}
+	status.Healthy = len(status.Problems) == 0
+	return status
+}
+
+// HealthHandler serves Health as JSON for a readiness probe, replying 200
+// when the pool is healthy and 503 otherwise.
+func (p *WorkerPool) HealthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		status := p.Health()
+		w.Header().Set("Content-Type", "application/json")
+		if !status.Healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(status)
+	})
+}
+
+// forgetWorker drops an exited worker from the registry, releases its
+// context and notes when it stopped.
+func (p *WorkerPool) forgetWorker(id int) {
+	now := p.clock().Now()
+	p.workersMu.Lock()
+	defer p.workersMu.Unlock()
+	p.stats[id].stopped = now
+	if h, ok := p.workers[id]; ok {
+		h.cancel()
+		delete(p.workers, id)
+	}
+}
+
+// taskLogger returns the pool logger annotated with a worker and its task,
+// including the task's metadata as a "metadata" group.
+func (p *WorkerPool) taskLogger(id int, task Task) *slog.Logger {
+	logger := p.logger.With("worker_id", id, "task_id", task.ID, "rider", task.Rider, "driver", task.Driver)
+	if len(task.Metadata) == 0 {
+		return logger
+	}
+	attrs := make([]any, 0, len(task.Metadata))
+	for _, k := range slices.Sorted(maps.Keys(task.Metadata)) {
+		attrs = append(attrs, slog.String(k, task.Metadata[k]))
+	}
+	return logger.With(slog.Group("metadata", attrs...))
+}
+
+// registry returns the configured driver registry, or the pool's own.
+func (p *WorkerPool) registry() *DriverRegistry {
+	if p.Drivers != nil {
+		return p.Drivers
+	}
+	return p.drivers
+}
+
+// acquireDriver marks driver as busy, returning a DriverBusyError if another
+// worker, in this pool or one sharing its registry, already holds it.
+func (p *WorkerPool) acquireDriver(driver string) error {
+	return p.registry().Acquire(driver)
+}
+
+// releaseDriver frees a driver previously taken with acquireDriver.
+func (p *WorkerPool) releaseDriver(driver string) {
+	p.registry().Release(driver)
+}
+
+// allowDriver reports whether the driver's breaker lets a task through,
+// moving an open breaker to half-open once its cooldown has passed.
+func (p *WorkerPool) allowDriver(driver string) bool {
+	p.driversMu.Lock()
+	defer p.driversMu.Unlock()
+
+	b, ok := p.breakers[driver]
+	if !ok {
+		return true
+	}
+	if b.state == BreakerOpen && p.clock().Now().Sub(b.openedAt) >= p.BreakerCooldown {
+		b.state = BreakerHalfOpen
+	}
+	switch b.state {
+	case BreakerOpen:
+		return false
+	case BreakerHalfOpen:
+		if b.trial {
+			return false // Only one trial at a time
+		}
+		b.trial = true
+	}
+	return true
+}
+
+// recordDriverOutcome feeds a task's outcome into the driver's breaker.
+func (p *WorkerPool) recordDriverOutcome(driver string, err error) {
+	if p.BreakerThreshold <= 0 {
+		return
+	}
+
+	p.driversMu.Lock()
+	defer p.driversMu.Unlock()
+
+	b, ok := p.breakers[driver]
+	if !ok {
+		if err == nil {
+			return
+		}
+		b = &circuitBreaker{}
+		p.breakers[driver] = b
+	}
+
+	b.trial = false
+	if err == nil {
+		b.state = BreakerClosed
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.state == BreakerHalfOpen || b.failures >= p.BreakerThreshold {
+		b.state = BreakerOpen
+		b.openedAt = p.clock().Now()
+		b.failures = 0
+	}
+}
+
+// releaseTrial frees a half-open trial slot without deciding the breaker's
+// state, for a trial task that ended without a real outcome.
+func (p *WorkerPool) releaseTrial(driver string) {
+	p.driversMu.Lock()
+	defer p.driversMu.Unlock()
+	if b, ok := p.breakers[driver]; ok {
+		b.trial = false
+	}
+}
+
+// SurgeMultiplier returns the pricing multiplier for the pool's current
+// load. It is 1.0 until the number of waiting riders per active worker
+// exceeds SurgeThreshold, then grows in proportion to the excess, up to
+// MaxSurge. A pool with no workers is treated as having one.
+func (p *WorkerPool) SurgeMultiplier() float64 {
+	threshold := p.SurgeThreshold
+	if threshold <= 0 {
+		threshold = defaultSurgeThreshold
+	}
+	maxSurge := p.MaxSurge
+	if maxSurge <= 0 {
+		maxSurge = defaultMaxSurge
+	}
+
+	ratio := float64(p.queueLen()) / float64(max(p.NumWorkers(), 1))
+	if ratio <= threshold {
+		return 1.0
+	}
+	return min(ratio/threshold, maxSurge)
+}
+
+// BreakerState reports the current state of driver's circuit breaker.
+func (p *WorkerPool) BreakerState(driver string) BreakerState {
+	p.driversMu.Lock()
+	defer p.driversMu.Unlock()
+
+	b, ok := p.breakers[driver]
+	if !ok {
+		return BreakerClosed
+	}
+	if b.state == BreakerOpen && p.clock().Now().Sub(b.openedAt) >= p.BreakerCooldown {
+		return BreakerHalfOpen
+	}
+	return b.state
+}
+
+// traceTask runs handleTask, inside a span when the pool has a Tracer. The
+// span carries the task's rider, driver and worker, and its outcome; it
+// records the attempt's error and is marked failed if the task failed or is
+// being retried.
+func (p *WorkerPool) traceTask(id int, task Task) {
+	if p.tracer == nil {
+		p.handleTask(context.Background(), id, task)
+		return
+	}
+
+	parent := task.submitCtx
+	if parent == nil {
+		parent = context.Background()
+	}
+	ctx, span := p.tracer.Start(parent, "assign_ride")
+	defer span.End()
+	span.SetAttributes(
+		slog.String("task_id", task.ID),
+		slog.String("rider", task.Rider),
+		slog.String("driver", task.Driver),
+		slog.Int("worker_id", id),
+		slog.Int("attempt", task.Retries+1),
+	)
+	ts := &taskSpan{span: span}
+	p.mu.Lock()
+	p.spans[task.ID] = ts
+	p.mu.Unlock()
+
+	p.handleTask(ctx, id, task)
+
+	p.mu.Lock()
+	delete(p.spans, task.ID)
+	p.mu.Unlock()
+	status, _ := p.store.Get(task.ID)
+	outcome := status.String()
+	if status == StatusQueued || status == StatusRunning {
+		outcome = "retrying" // Requeued, and perhaps already picked up again
+	}
+	span.SetAttributes(slog.String("outcome", outcome))
+	switch {
+	case status == StatusCompleted:
+		span.SetStatus(SpanOK, "")
+	case ts.err != nil:
+		span.SetStatus(SpanError, ts.err.Error())
+	}
+}
+
+// traceError records err on the span of the task's attempt in progress, if
+// it is being traced.
+func (p *WorkerPool) traceError(taskID string, err error) {
+	p.mu.Lock()
+	ts, ok := p.spans[taskID]
+	if ok {
+		ts.err = err
+	}
+	p.mu.Unlock()
+	if ok {
+		ts.span.RecordError(err)
+	}
+}
+
+// handleTask processes a single task and records its outcome. The in-flight
+// gauge covers the whole call and is released even if recording the outcome
+// panics. The values of trace, which carries the attempt's span when
+// tracing, are merged into the context given to Process.
+func (p *WorkerPool) handleTask(trace context.Context, id int, task Task) {
+	p.inFlight.Add(1)
+	defer p.inFlight.Add(-1)
+
+	p.workersMu.Lock()
+	p.stats[id].stats.Tasks++
+	p.workersMu.Unlock()
+
+	logger := p.taskLogger(id, task)
+
+	// An assignment that starts after the rider's deadline is pointless
+	now := p.clock().Now()
+	if !task.Deadline.IsZero() && now.After(task.Deadline) {
+		logger.Warn("task expired", "event", "expired", "deadline", task.Deadline)
+		p.recordExpired(task)
+		return
+	}
+	if waited := now.Sub(task.queuedAt); p.MaxQueueWait > 0 && waited > p.MaxQueueWait {
+		logger.Warn("task waited too long in queue", "event", "expired", "waited", waited, "max_queue_wait", p.MaxQueueWait)
+		p.recordExpired(task)
+		return
+	}
+
+	// Never "assign" a blank rider or driver; retrying would not help
+	if err := validateFields(task); err != nil {
+		logger.Warn("skipping invalid task", "event", "invalid", "error", err)
+		p.recordFailure(id, task, err)
+		return
+	}
+
+	if !p.waitForRateLimit() {
+		logger.Warn("cancelled while waiting for rate limit", "event", "cancelled", "cause", context.Cause(p.ctx))
+		p.recordFailure(id, task, context.Cause(p.ctx))
+		return
+	}
+
+	if !p.allowDriver(task.Driver) {
+		logger.Warn("driver circuit open", "event", "circuit_open")
+		p.recordFailure(id, task, ErrCircuitOpen)
+		return
+	}
+
+	// A driver can only serve one rider at a time; a conflicting task goes
+	// through the normal retry path and is recorded as failed once retries
+	// run out.
+	if err := p.acquireDriver(task.Driver); err != nil {
+		logger.Warn("driver conflict", "event", "conflict", "error", err)
+		p.releaseTrial(task.Driver)
+		p.retryOrFail(id, task, err)
+		return
+	}
+
+	logger.Info("processing task", "event", "start")
+	p.recordEvent(EventStart, task.ID, id, nil)
+
+	// Register a per-task context so CancelTask can abort this task. It
+	// derives from the caller's context rather than the pool's own, so
+	// cancelling the parent aborts the task while Shutdown(false) still
+	// lets it finish, by way of the current generation so CancelAll aborts
+	// it too. A task from a generation CancelAll has since ended never starts.
+	p.mu.Lock()
+	if task.generation != p.generation.Load() {
+		p.mu.Unlock()
+		logger.Info("task cancelled", "event", "cancelled")
+		p.releaseDriver(task.Driver)
+		p.releaseTrial(task.Driver)
+		p.recordCancelled(task)
+		return
+	}
+	ctx, cancel := context.WithCancelCause(valuesContext{Context: p.genCtx, values: trace})
+	p.running[task.ID] = cancel
+	p.mu.Unlock()
+	if !task.Deadline.IsZero() {
+		var cancelDeadline context.CancelFunc
+		ctx, cancelDeadline = context.WithDeadline(ctx, task.Deadline)
+		defer cancelDeadline()
+	}
+
+	surge := p.SurgeMultiplier()
+	startedAt := p.clock().Now()
+	task.StartedAt = startedAt
+	hold := p.holdDriver(task.Driver)
+	var result Result
+	var err error
+	if p.DryRun {
+		result, err = p.dryRun(logger, task)
+	} else {
+		result, err = p.runTask(ctx, logger, task, hold)
+	}
+
+	p.mu.Lock()
+	delete(p.running, task.ID)
+	p.mu.Unlock()
+	cancel(nil)
+
+	// A successful proposal keeps its driver until confirmed, below; any
+	// other outcome frees the driver before the task is retried or recorded
+	if err != nil {
+		hold.done()
+	}
+	if errors.Is(err, ErrTaskCancelled) {
+		logger.Info("task cancelled", "event", "cancelled")
+		p.releaseTrial(task.Driver)
+		p.recordCancelled(task)
+		return
+	}
+	if failureReason(err) == FailureCancelled {
+		// Aborted by a shutdown or cancelled context, which says nothing
+		// about the driver
+		p.releaseTrial(task.Driver)
+	} else {
+		p.recordDriverOutcome(task.Driver, err)
+	}
+
+	var pe *panicError
+	if errors.As(err, &pe) {
+		p.mu.Lock()
+		p.panics = append(p.panics, PanicRecord{TaskID: task.ID, Value: pe.value, Stack: pe.stack, WorkerID: id})
+		p.mu.Unlock()
+	}
+
+	var fatal *FatalError
+	if errors.As(err, &fatal) {
+		logger.Error("fatal error, stopping pool", "event", "fatal", "error", err)
+		p.recordFailure(id, task, err)
+		p.fail(err)
+		return
+	}
+
+	if err != nil {
+		if errors.Is(err, ErrTaskTimeout) {
+			logger.Warn("task timed out", "event", "timeout", "timeout", p.TaskTimeout)
+		} else {
+			logger.Error("error processing task", "event", "error", "error", err)
+		}
+
+		p.retryOrFail(id, task, err)
+		return
+	}
+
+	result.TaskID = task.ID
+	result.Seq = task.Seq
+	result.Rating = task.DriverRating
+	result.WorkerID = id
+	result.StartedAt = startedAt
+	result.Wait = startedAt.Sub(task.EnqueuedAt)
+	result.Duration = p.clock().Now().Sub(startedAt)
+	result.Surge = surge
+	result.Metadata = maps.Clone(task.Metadata)
+
+	// The driver stays booked while deciding, so no other task can propose
+	// them a second ride in the meantime
+	accepted := p.Acceptor == nil || p.confirm(result)
+	hold.done()
+	if !accepted {
+		p.reassign(id, task)
+		return
+	}
+
+	// Use mutex to safely append to shared results slice
+	p.mu.Lock()
+	p.results = append(p.results, result)
+	p.latencies = append(p.latencies, result.Duration)
+	if p.MaxRetainedResults > 0 && len(p.results) > p.MaxRetainedResults {
+		// Shift down in place so the backing array never outgrows the cap
+		n := copy(p.results, p.results[len(p.results)-p.MaxRetainedResults:])
+		p.results = p.results[:n]
+		n = copy(p.latencies, p.latencies[len(p.latencies)-p.MaxRetainedResults:])
+		p.latencies = p.latencies[:n]
+	}
+	p.mu.Unlock()
+	p.completed.Add(1)
+	p.recordEvent(EventComplete, task.ID, id, nil)
+
+	if p.OnComplete != nil {
+		p.serialized(func() { p.OnComplete(result) })
+	}
+	p.settle(task, &result)
+
+	logger.Info("finished task", "event", "complete")
+}
+
+// demoTasks returns the built-in Rider1..Rider10 demo assignments.
+func demoTasks() []Task {
+	tasks := make([]Task, 0, 10)
+	for i := 1; i <= 10; i++ {
+		tasks = append(tasks, NewTask(fmt.Sprintf("Rider%d", i), fmt.Sprintf("Driver%d", i)))
+	}
+	return tasks
+}
+
+// HandleSignals catches SIGINT and SIGTERM for pool. The first drains the
+// pool with ShutdownWithTimeout(timeout), so running tasks can finish and
+// their results are kept, and cancels the returned context, e.g. to stop
+// Serve; whoever is waiting on the pool then reports as usual. A second
+// signal exits the process straight away with status 1. Call stop once the
+// run is over to restore the default signal behaviour.
+func HandleSignals(pool *WorkerPool, timeout time.Duration) (ctx context.Context, stop func()) {
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go pool.handleSignals(sigs, done, cancel, timeout, os.Exit)
+
+	var once sync.Once
+	return ctx, func() {
+		once.Do(func() {
+			signal.Stop(sigs)
+			close(done)
+			cancel()
+		})
+	}
+}
+
+// handleSignals implements HandleSignals on signals from sigs until done is
+// closed, calling cancel on the first and exit on the second.
+func (p *WorkerPool) handleSignals(sigs <-chan os.Signal, done <-chan struct{}, cancel context.CancelFunc, timeout time.Duration, exit func(code int)) {
+	select {
+	case sig := <-sigs:
+		p.logger.Warn("signal received, draining pool", "event", "signal", "signal", sig.String(), "timeout", timeout)
+	case <-done:
+		return
+	}
+	cancel()
+	go func() {
+		if left := p.ShutdownWithTimeout(timeout); left > 0 {
+			p.logger.Warn("drain timed out", "event", "signal", "abandoned", left)
+		}
+	}()
+
+	select {
+	case sig := <-sigs:
+		p.logger.Error("second signal received, exiting", "event", "signal", "signal", sig.String())
+		exit(1)
+	case <-done:
+	}
+}
+
+// loadTasks reads tasks from the JSON file at path, or returns the demo
+// tasks when path is empty.
+func loadTasks(path string) ([]Task, error) {
+	if path == "" {
+		return demoTasks(), nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return LoadTasksFromJSON(f)
+}
+
+func main() {
+	numWorkers := flag.Int("workers", defaultWorkers, "number of concurrent workers")
+	bufferSize := flag.Int("buffer", defaultBufferSize, "capacity of the task queue")
+	input := flag.String("input", "", "path to a JSON file of tasks (default: built-in demo tasks)")
+	progress := flag.Duration("progress", 0, "interval between progress reports (0 disables them)")
+	addr := flag.String("addr", "", "serve the pool over HTTP on this address instead of running the batch")
+	stdin := flag.Bool("stdin", false, "stream newline-delimited JSON tasks from stdin instead of loading -input")
+	drainTimeout := flag.Duration("drain-timeout", 10*time.Second, "how long Ctrl-C waits for running tasks before abandoning them")
+	flag.Parse()
+
+	if *numWorkers <= 0 {
+		fmt.Fprintf(os.Stderr, "-workers must be positive, got %d\n", *numWorkers)
+		os.Exit(2)
+	}
+	if *bufferSize <= 0 {
+		fmt.Fprintf(os.Stderr, "-buffer must be positive, got %d\n", *bufferSize)
+		os.Exit(2)
+	}
+
+	tasks, err := loadTasks(*input)
+	if err != nil {
+		log.Fatalf("loading tasks: %v", err)
+	}
+
+	pool := NewWorkerPool(WithWorkers(*numWorkers), WithBuffer(*bufferSize))
+
+	// Start worker goroutines
+	pool.Start()
+	if *progress > 0 {
+		pool.StartProgressReporter(*progress)
+	}
+	ctx, stop := HandleSignals(pool, *drainTimeout) // Ctrl-C drains; a second Ctrl-C exits
+	defer stop()
+
+	// Send ride tasks to the pool
+	var serveErr error
+	switch {
+	case *addr != "":
+		log.Printf("serving on %s", *addr)
+		serveErr = pool.Serve(ctx, *addr)
+	case *stdin:
+		// Read in the background so Ctrl-C is not stuck behind a read that
+		// may never return; the reader is left behind when main exits
+		read := make(chan error, 1)
+		go func() { read <- StreamTasksFromReader(os.Stdin, pool.Submit) }()
+		select {
+		case err := <-read:
+			if err != nil {
+				log.Printf("reading tasks: %v", err)
+			}
+		case <-ctx.Done():
+			log.Printf("interrupted, no longer reading tasks")
+		}
+	default:
+		pool.SubmitBatch(tasks)
+	}
+
+	results, err := pool.Wait() // Drain the queue and wait for all workers to complete
+
+	// Print final assignment results; a server's can be looked up over HTTP
+	if *addr == "" {
+		fmt.Println("\nAll Assignments:")
+		for _, r := range results {
+			fmt.Println(r.String())
+		}
+	}
+	fmt.Println()
+	fmt.Print(pool.Summary())
+	if serveErr != nil {
+		log.Fatalf("serving: %v", serveErr)
+	}
+	if err != nil {
+		log.Fatalf("pool stopped early: %v", err)
 	}
 }
@@ -0,0 +1,3475 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// processorFunc adapts an ordinary function to TaskProcessor.
+type processorFunc func(ctx context.Context, logger *slog.Logger, task Task) (Result, error)
+
+func (f processorFunc) Process(ctx context.Context, logger *slog.Logger, task Task) (Result, error) {
+	return f(ctx, logger, task)
+}
+
+// assign is a processor that makes every assignment straight away, without
+// SleepProcessor's delay or its "Assigned ..." line on stdout.
+func assign(_ context.Context, _ *slog.Logger, task Task) (Result, error) {
+	return Result{Rider: task.Rider, Riders: slices.Clone(task.Riders), Driver: task.Driver}, nil
+}
+
+// acceptorFunc adapts an ordinary function to Acceptor.
+type acceptorFunc func(ctx context.Context, proposal Result) bool
+
+func (f acceptorFunc) Accept(ctx context.Context, proposal Result) bool {
+	return f(ctx, proposal)
+}
+
+// newTestPool creates a silent pool running processor.
+func newTestPool(workers, buffer int, processor TaskProcessor) *WorkerPool {
+	return NewWorkerPoolWithProcessor(context.Background(), workers, buffer, DiscardLogger(), processor)
+}
+
+// overlap tracks how many calls are in progress at once.
+type overlap struct {
+	mu       sync.Mutex
+	current  int
+	reported int // Highest value of current seen
+}
+
+func (o *overlap) enter() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.current++
+	o.reported = max(o.reported, o.current)
+}
+
+func (o *overlap) leave() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.current--
+}
+
+func (o *overlap) max() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.reported
+}
+
+func TestAcceptorRejectionReassignsToNextDriver(t *testing.T) {
+	p := newTestPool(2, 10, processorFunc(assign))
+	p.Acceptor = acceptorFunc(func(_ context.Context, proposal Result) bool {
+		return proposal.Driver != "DriverA"
+	})
+	p.Start()
+
+	task := NewTask("Rider1", "DriverA")
+	task.Candidates = []Driver{{Name: "DriverB"}, {Name: "DriverC"}}
+	if err := p.Submit(task); err != nil {
+		t.Fatal(err)
+	}
+	results, err := p.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(results) != 1 || results[0].Driver != "DriverB" {
+		t.Fatalf("results = %v, want Rider1 reassigned to DriverB", results)
+	}
+	if f := p.Failures(); len(f) != 0 {
+		t.Errorf("failures = %v, want none", f)
+	}
+}
+
+func TestAcceptorRejectedByEveryDriverFails(t *testing.T) {
+	p := newTestPool(1, 10, processorFunc(assign))
+	p.Acceptor = acceptorFunc(func(context.Context, Result) bool { return false })
+	p.Start()
+
+	task := NewTask("Rider1", "DriverA")
+	task.Candidates = []Driver{{Name: "DriverB"}}
+	p.Submit(task)
+	results, _ := p.Wait()
+
+	if len(results) != 0 {
+		t.Errorf("results = %v, want none", results)
+	}
+	f := p.Failures()
+	if len(f) != 1 || f[0].Reason != FailureDriverUnavailable {
+		t.Fatalf("failures = %v, want one FailureDriverUnavailable", f)
+	}
+}
+
+func TestAcceptorHoldsDriverWhileConfirming(t *testing.T) {
+	var pending overlap
+	p := newTestPool(2, 10, processorFunc(assign))
+	p.MaxRetries = 10
+	p.RetryBackoff = 5 * time.Millisecond
+	p.Acceptor = acceptorFunc(func(context.Context, Result) bool {
+		pending.enter()
+		defer pending.leave()
+		time.Sleep(30 * time.Millisecond)
+		return true
+	})
+	p.Start()
+
+	p.Submit(NewTask("Rider1", "D"))
+	p.Submit(NewTask("Rider2", "D"))
+	results, _ := p.Wait()
+
+	if n := pending.max(); n != 1 {
+		t.Errorf("%d proposals to driver D pending at once, want 1", n)
+	}
+	if len(results) != 2 {
+		t.Errorf("got %d results, want 2; failures: %v", len(results), p.Failures())
+	}
+}
+
+// sliceQueue is an unbounded Queue kept in a slice, standing in for an
+// external backend.
+type sliceQueue struct {
+	mu       sync.Mutex
+	ready    *sync.Cond
+	tasks    []Task
+	enqueued int
+	closed   bool
+}
+
+func newSliceQueue() *sliceQueue {
+	q := &sliceQueue{}
+	q.ready = sync.NewCond(&q.mu)
+	return q
+}
+
+func (q *sliceQueue) Enqueue(_ context.Context, task Task) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return ErrPoolClosed
+	}
+	q.tasks = append(q.tasks, task)
+	q.enqueued++
+	q.ready.Signal()
+	return nil
+}
+
+func (q *sliceQueue) Dequeue(ctx context.Context) (Task, bool) {
+	stop := context.AfterFunc(ctx, func() {
+		q.mu.Lock()
+		q.ready.Broadcast()
+		q.mu.Unlock()
+	})
+	defer stop()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.tasks) == 0 && !q.closed && ctx.Err() == nil {
+		q.ready.Wait()
+	}
+	if len(q.tasks) == 0 {
+		return Task{}, false
+	}
+	task := q.tasks[0]
+	q.tasks = q.tasks[1:]
+	return task, true
+}
+
+func (q *sliceQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.tasks)
+}
+
+func (q *sliceQueue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.ready.Broadcast()
+	return nil
+}
+
+func TestQueueBackends(t *testing.T) {
+	slice := newSliceQueue()
+	tests := []struct {
+		name  string
+		queue Queue
+	}{
+		{"channel", NewChannelQueue(2)},
+		{"slice", slice},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewWorkerPool(WithWorkers(2), WithBuffer(1), WithLogger(DiscardLogger()),
+				WithProcessor(processorFunc(assign)), WithQueue(tt.queue))
+			p.Start()
+			for i := range 10 {
+				if err := p.Submit(NewTaskWithID(strconv.Itoa(i), "Rider", "Driver"+strconv.Itoa(i))); err != nil {
+					t.Fatal(err)
+				}
+			}
+			results, err := p.Wait()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			seen := make(map[string]bool)
+			for _, r := range results {
+				seen[r.TaskID] = true
+			}
+			if len(results) != 10 || len(seen) != 10 {
+				t.Errorf("got %d results for %d tasks, want 10 distinct", len(results), len(seen))
+			}
+			if n := tt.queue.Len(); n != 0 {
+				t.Errorf("backend still holds %d tasks", n)
+			}
+		})
+	}
+	if slice.enqueued != 10 {
+		t.Errorf("slice backend saw %d tasks, want 10", slice.enqueued)
+	}
+}
+
+func TestTrySubmitWithFullBackendDoesNotBlock(t *testing.T) {
+	backend := NewChannelQueue(1)
+	p := NewWorkerPool(WithWorkers(1), WithBuffer(1), WithLogger(DiscardLogger()),
+		WithProcessor(processorFunc(assign)), WithQueue(backend))
+	p.Start()
+	p.Pause()
+
+	// One task in the buffer, one held by the pump and one in the backend
+	for i := range 3 {
+		p.Submit(NewTask("Rider"+strconv.Itoa(i), "Driver"+strconv.Itoa(i)))
+	}
+	accepted := make(chan bool)
+	go func() { accepted <- p.TrySubmit(NewTask("Rider3", "Driver3")) }()
+	select {
+	case ok := <-accepted:
+		if ok {
+			t.Error("TrySubmit accepted a task with the backend full")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("TrySubmit blocked on a full backend")
+	}
+
+	p.Resume()
+	if results, _ := p.Wait(); len(results) != 3 {
+		t.Errorf("got %d results, want 3", len(results))
+	}
+}
+
+// collect drains results until it is closed, failing the test if that
+// takes longer than timeout.
+func collect(t *testing.T, results <-chan Result, timeout time.Duration) []Result {
+	t.Helper()
+	var got []Result
+	deadline := time.After(timeout)
+	for {
+		select {
+		case r, ok := <-results:
+			if !ok {
+				return got
+			}
+			got = append(got, r)
+		case <-deadline:
+			t.Fatalf("stream not closed after %v; got %d results", timeout, len(got))
+		}
+	}
+}
+
+func TestStream(t *testing.T) {
+	p := newTestPool(3, 10, processorFunc(assign))
+	p.Start()
+	defer p.Shutdown(true)
+
+	tasks := make(chan Task)
+	go func() {
+		defer close(tasks)
+		for i := 1; i <= 5; i++ {
+			tasks <- NewTask(fmt.Sprintf("Rider%d", i), fmt.Sprintf("Driver%d", i))
+		}
+	}()
+	got := collect(t, p.Stream(tasks), 5*time.Second)
+
+	riders := make([]string, 0, len(got))
+	for _, r := range got {
+		riders = append(riders, r.Rider)
+	}
+	slices.Sort(riders)
+	want := []string{"Rider1", "Rider2", "Rider3", "Rider4", "Rider5"}
+	if !slices.Equal(riders, want) {
+		t.Errorf("streamed riders = %v, want %v", riders, want)
+	}
+}
+
+func TestStreamWithDuplicateIDs(t *testing.T) {
+	p := newTestPool(2, 10, processorFunc(assign))
+	p.Start()
+	defer p.Shutdown(true)
+
+	tasks := make(chan Task, 2)
+	tasks <- NewTaskWithID("x", "Rider1", "Driver1")
+	tasks <- NewTaskWithID("x", "Rider2", "Driver2")
+	close(tasks)
+
+	if got := collect(t, p.Stream(tasks), 5*time.Second); len(got) != 2 {
+		t.Errorf("got %d results, want 2", len(got))
+	}
+}
+
+// errNoShow is the error a failing test processor returns.
+var errNoShow = errors.New("driver did not show up")
+
+func TestCircuitBreakerTrips(t *testing.T) {
+	p := newTestPool(1, 10, processorFunc(func(ctx context.Context, logger *slog.Logger, task Task) (Result, error) {
+		if task.Driver == "Bad" {
+			return Result{}, errNoShow
+		}
+		return assign(ctx, logger, task)
+	}))
+	p.BreakerThreshold = 3
+	p.BreakerCooldown = time.Hour
+	p.Start()
+
+	for i := range 3 {
+		p.Submit(NewTask(fmt.Sprintf("Rider%d", i), "Bad"))
+	}
+	for p.Metrics().Failed < 3 {
+		time.Sleep(time.Millisecond)
+	}
+	if s := p.BreakerState("Bad"); s != BreakerOpen {
+		t.Fatalf("breaker after 3 failures = %v, want open", s)
+	}
+	p.Submit(NewTask("Rider3", "Bad"))
+	p.Submit(NewTask("Rider4", "Good"))
+	results, _ := p.Wait()
+
+	f := p.Failures()
+	if len(f) != 4 || !errors.Is(f[3].Err, ErrCircuitOpen) || f[3].Reason != FailureDriverUnavailable {
+		t.Errorf("failures = %v, want the fourth short-circuited with ErrCircuitOpen", f)
+	}
+	if len(results) != 1 || results[0].Driver != "Good" {
+		t.Errorf("results = %v, want only the Good driver's", results)
+	}
+	if s := p.BreakerState("Good"); s != BreakerClosed {
+		t.Errorf("Good driver's breaker = %v, want closed", s)
+	}
+}
+
+func TestCircuitBreakerIgnoresShutdown(t *testing.T) {
+	started := make(chan struct{})
+	p := newTestPool(1, 10, processorFunc(func(ctx context.Context, _ *slog.Logger, _ Task) (Result, error) {
+		close(started)
+		<-ctx.Done()
+		return Result{}, context.Cause(ctx)
+	}))
+	p.BreakerThreshold = 1
+	p.BreakerCooldown = time.Hour
+	p.Start()
+
+	p.Submit(NewTask("Rider1", "D"))
+	<-started
+	if left := p.ShutdownWithTimeout(10 * time.Millisecond); left != 1 {
+		t.Errorf("ShutdownWithTimeout left %d tasks undone, want 1", left)
+	}
+	if s := p.BreakerState("D"); s != BreakerClosed {
+		t.Errorf("breaker after an aborted task = %v, want closed", s)
+	}
+}
+
+func TestProcessAbortsPromptlyOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	time.AfterFunc(10*time.Millisecond, func() { cancel(ErrTaskCancelled) })
+
+	start := time.Now()
+	err := NewTask("Rider1", "Driver1").Process(ctx)
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("Process took %v after cancellation, want under 100ms", elapsed)
+	}
+	if !errors.Is(err, ErrTaskCancelled) {
+		t.Errorf("Process() = %v, want the cancellation cause", err)
+	}
+}
+
+// blockingProcessor returns a processor that signals on started as each
+// task begins and then holds it until release is closed or ctx ends.
+func blockingProcessor(started chan<- string, release <-chan struct{}) TaskProcessor {
+	return processorFunc(func(ctx context.Context, logger *slog.Logger, task Task) (Result, error) {
+		started <- task.ID
+		select {
+		case <-release:
+			return assign(ctx, logger, task)
+		case <-ctx.Done():
+			return Result{}, context.Cause(ctx)
+		}
+	})
+}
+
+func TestStuckWorkerDetected(t *testing.T) {
+	started, release := make(chan string, 1), make(chan struct{})
+	clock := NewFakeClock(time.Now())
+	p := newTestPool(2, 10, blockingProcessor(started, release))
+	p.Clock = clock
+	p.StuckThreshold = time.Minute
+	p.Start()
+
+	p.Submit(NewTask("Rider1", "Driver1"))
+	<-started
+	stuck := func() []int {
+		// Let the monitor check, then wait for it to do so
+		for clock.Waiters() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		clock.Advance(31 * time.Second)
+		for clock.Waiters() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		return p.StuckWorkers()
+	}
+	if ids := stuck(); len(ids) != 0 {
+		t.Errorf("stuck after 31s = %v, want none", ids)
+	}
+	if ids := stuck(); len(ids) != 1 {
+		t.Errorf("stuck after 62s = %v, want the busy worker", ids)
+	}
+
+	close(release)
+	p.Shutdown(true)
+}
+
+func TestStuckMonitorWithTinyThreshold(t *testing.T) {
+	started, release := make(chan string, 1), make(chan struct{})
+	p := newTestPool(1, 10, blockingProcessor(started, release))
+	p.StuckThreshold = time.Nanosecond
+	p.Start()
+
+	p.Submit(NewTask("Rider1", "Driver1"))
+	<-started
+	deadline := time.Now().Add(time.Second)
+	for len(p.StuckWorkers()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if ids := p.StuckWorkers(); !slices.Equal(ids, []int{1}) {
+		t.Errorf("StuckWorkers() = %v, want [1]", ids)
+	}
+	close(release)
+	p.Shutdown(true)
+}
+
+func TestWaitReturnsFatalError(t *testing.T) {
+	errDown := errors.New("dispatch database down")
+	p := newTestPool(1, 10, processorFunc(func(ctx context.Context, logger *slog.Logger, task Task) (Result, error) {
+		switch task.Rider {
+		case "Rider2":
+			return Result{}, Fatal(errDown)
+		case "Rider3":
+			return Result{}, errNoShow // Recoverable: fails just this task
+		}
+		return assign(ctx, logger, task)
+	}))
+	p.Start()
+	p.Submit(NewTask("Rider1", "Driver1"))
+	p.Submit(NewTask("Rider3", "Driver3"))
+	p.Submit(NewTask("Rider2", "Driver2"))
+	for i := 4; i <= 10; i++ {
+		p.Submit(NewTask(fmt.Sprintf("Rider%d", i), fmt.Sprintf("Driver%d", i)))
+	}
+	results, err := p.Wait()
+
+	var fatal *FatalError
+	if !errors.As(err, &fatal) || !errors.Is(err, errDown) {
+		t.Fatalf("Wait() error = %v, want the FatalError wrapping %v", err, errDown)
+	}
+	if errors.Is(err, errNoShow) {
+		t.Errorf("Wait() error = %v includes a recoverable task failure", err)
+	}
+	if len(results) != 1 || results[0].Rider != "Rider1" {
+		t.Errorf("results = %v, want only Rider1, which ran before the fatal error", results)
+	}
+	if len(p.Failures()) != 2 {
+		t.Errorf("failures = %v, want Rider3 and Rider2", p.Failures())
+	}
+}
+
+func TestSubmitRacingShutdown(t *testing.T) {
+	for range 20 {
+		p := newTestPool(4, 8, processorFunc(assign))
+		p.Start()
+
+		var wg sync.WaitGroup
+		var accepted atomic.Int64
+		errs := make(chan error, 50*20)
+		for g := range 50 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := range 20 {
+					err := p.Submit(NewTask(fmt.Sprintf("Rider%d-%d", g, i), fmt.Sprintf("Driver%d-%d", g, i)))
+					if err == nil {
+						accepted.Add(1)
+					} else if err != ErrPoolClosed {
+						errs <- err
+					}
+				}
+			}()
+		}
+		p.Shutdown(true)
+		wg.Wait()
+		close(errs)
+
+		for err := range errs {
+			t.Errorf("Submit during Shutdown returned %v, want nil or ErrPoolClosed", err)
+		}
+		if n := int64(len(p.Results())); n != accepted.Load() {
+			t.Errorf("%d tasks accepted but %d completed", accepted.Load(), n)
+		}
+	}
+}
+
+// benchTasks returns n tasks, each with its own driver.
+func benchTasks(n int) []Task {
+	tasks := make([]Task, n)
+	for i := range tasks {
+		tasks[i] = NewTask(fmt.Sprintf("Rider%d", i), fmt.Sprintf("Driver%d", i))
+	}
+	return tasks
+}
+
+func TestRunAllLeavesNoGoroutines(t *testing.T) {
+	before := runtime.NumGoroutine()
+	for range 5 {
+		results, err := RunAll(4, processorFunc(assign), benchTasks(50))
+		if err != nil || len(results) != 50 {
+			t.Fatalf("RunAll() = %d results, %v; want 50, nil", len(results), err)
+		}
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("%d goroutines before RunAll, %d after", before, after)
+	}
+}
+
+func BenchmarkRunAll(b *testing.B) {
+	const n = 1000
+	for _, workers := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			tasks := benchTasks(n)
+			for b.Loop() {
+				if _, err := RunAll(workers, processorFunc(assign), tasks); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(n*b.N)/b.Elapsed().Seconds(), "tasks/sec")
+		})
+	}
+}
+
+func TestTimedOutTaskKeepsDriverUntilProcessReturns(t *testing.T) {
+	var calls overlap
+	p := newTestPool(2, 10, processorFunc(func(ctx context.Context, logger *slog.Logger, task Task) (Result, error) {
+		calls.enter()
+		defer calls.leave()
+		time.Sleep(50 * time.Millisecond) // Ignores ctx, as a careless processor might
+		return assign(ctx, logger, task)
+	}))
+	p.TaskTimeout = 10 * time.Millisecond
+	p.MaxRetries = 2
+	p.RetryBackoff = 5 * time.Millisecond
+	p.Start()
+
+	p.Submit(NewTask("Rider1", "D"))
+	p.Submit(NewTask("Rider2", "D"))
+	results, _ := p.Wait()
+	for p.registry().Busy("D") {
+		time.Sleep(time.Millisecond) // Abandoned calls may still be running
+	}
+
+	if n := calls.max(); n != 1 {
+		t.Errorf("%d Process calls for driver D overlapped, want 1", n)
+	}
+	if len(results) != 0 {
+		t.Errorf("results = %v, want none from timed-out tasks", results)
+	}
+	var timeouts, busy int
+	for _, f := range p.Failures() {
+		switch f.Reason {
+		case FailureTimeout:
+			timeouts++
+		case FailureDriverUnavailable:
+			busy++
+		}
+	}
+	if timeouts+busy != 2 || busy == 0 {
+		t.Errorf("failures = %v, want both tasks failed, at least one on a busy driver", p.Failures())
+	}
+}
+
+// slowAssign is assign after a short pause, so tasks are still queued while
+// a test acts on the pool.
+func slowAssign(ctx context.Context, logger *slog.Logger, task Task) (Result, error) {
+	time.Sleep(5 * time.Millisecond)
+	return assign(ctx, logger, task)
+}
+
+func TestShutdownDrainsQueue(t *testing.T) {
+	p := newTestPool(2, 10, processorFunc(slowAssign))
+	p.Start()
+	for _, task := range demoTasks() {
+		p.Submit(task)
+	}
+	p.Shutdown(true)
+
+	if n := len(p.Results()); n != 10 {
+		t.Errorf("got %d results after Shutdown(true), want all 10", n)
+	}
+}
+
+func TestShutdownWithoutDrainStopsEarly(t *testing.T) {
+	p := newTestPool(1, 100, processorFunc(slowAssign))
+	p.Start()
+	for i := range 100 {
+		p.Submit(NewTask(fmt.Sprintf("Rider%d", i), fmt.Sprintf("Driver%d", i)))
+	}
+	p.Shutdown(false)
+
+	if n := len(p.Results()); n >= 100 {
+		t.Errorf("Shutdown(false) ran all %d tasks, want it to stop after the current one", n)
+	}
+}
+
+func TestAddWorkersRaisesThroughput(t *testing.T) {
+	p := newTestPool(2, 1000, processorFunc(func(ctx context.Context, logger *slog.Logger, task Task) (Result, error) {
+		time.Sleep(10 * time.Millisecond)
+		return assign(ctx, logger, task)
+	}))
+	p.Start()
+	for i := range 1000 {
+		p.Submit(NewTask(fmt.Sprintf("Rider%d", i), fmt.Sprintf("Driver%d", i)))
+	}
+	completedIn := func(d time.Duration) int64 {
+		before := p.Metrics().Completed
+		time.Sleep(d)
+		return p.Metrics().Completed - before
+	}
+
+	slow := completedIn(200 * time.Millisecond)
+	p.AddWorkers(4)
+	completedIn(20 * time.Millisecond) // Let the new workers get going
+	fast := completedIn(200 * time.Millisecond)
+	p.Shutdown(false)
+
+	if fast < slow*2 {
+		t.Errorf("completed %d tasks in 200ms with 2 workers and %d with 6, want at least twice as many", slow, fast)
+	}
+	if ids := p.WorkerIDs(); len(ids) != 0 {
+		t.Errorf("workers still running after shutdown: %v", ids)
+	}
+	if counts := p.WorkerTaskCounts(); len(counts) != 6 {
+		t.Errorf("WorkerTaskCounts() = %v, want 6 distinct workers", counts)
+	}
+}
+
+func TestLoadTasksFromJSON(t *testing.T) {
+	blob := `[
+		{"rider": "Rider1", "driver": "Driver1"},
+		{"rider": "Rider2", "driver": "Driver2"}
+	]`
+	tasks, err := LoadTasksFromJSON(strings.NewReader(blob))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tasks) != 2 {
+		t.Fatalf("got %d tasks, want 2", len(tasks))
+	}
+	for i, task := range tasks {
+		rider, driver := fmt.Sprintf("Rider%d", i+1), fmt.Sprintf("Driver%d", i+1)
+		if task.Rider != rider || task.Driver != driver || task.ID == "" {
+			t.Errorf("task %d = %+v, want %s with %s and an ID", i, task, rider, driver)
+		}
+	}
+	if tasks[0].ID == tasks[1].ID {
+		t.Errorf("both tasks have ID %q", tasks[0].ID)
+	}
+}
+
+func TestLoadTasksFromJSONErrors(t *testing.T) {
+	tests := []struct {
+		name, blob, want string
+		invalid          bool
+	}{
+		{"malformed", `[{"rider": "Rider1",`, "decoding tasks", false},
+		{"not an array", `{"rider": "Rider1", "driver": "Driver1"}`, "decoding tasks", false},
+		{"missing rider", `[{"rider": "Rider1", "driver": "Driver1"}, {"driver": "Driver2"}]`, "task 1", true},
+		{"missing driver", `[{"rider": "Rider1"}]`, "task 0", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tasks, err := LoadTasksFromJSON(strings.NewReader(tt.blob))
+			if err == nil {
+				t.Fatalf("LoadTasksFromJSON() = %v, want an error", tasks)
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error %q does not mention %q", err, tt.want)
+			}
+			if errors.Is(err, ErrInvalidTask) != tt.invalid {
+				t.Errorf("errors.Is(%v, ErrInvalidTask) = %v, want %v", err, !tt.invalid, tt.invalid)
+			}
+		})
+	}
+}
+
+func TestDriverNeverDoubleBooked(t *testing.T) {
+	t.Run("conflict surfaced", func(t *testing.T) {
+		started, release := make(chan string, 1), make(chan struct{})
+		p := newTestPool(2, 10, blockingProcessor(started, release))
+		p.Start()
+
+		p.Submit(NewTask("Rider1", "Driver1"))
+		<-started
+		p.Submit(NewTask("Rider2", "Driver1"))
+		for p.Metrics().Failed == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		close(release)
+		results, _ := p.Wait()
+
+		f := p.Failures()
+		var busy *DriverBusyError
+		if len(f) != 1 || !errors.As(f[0].Err, &busy) || busy.Driver != "Driver1" || f[0].Task.Rider != "Rider2" {
+			t.Fatalf("failures = %v, want Rider2 failed with a DriverBusyError for Driver1", f)
+		}
+		if len(results) != 1 || results[0].Rider != "Rider1" {
+			t.Errorf("results = %v, want only Rider1", results)
+		}
+	})
+
+	t.Run("retried until free", func(t *testing.T) {
+		var calls overlap
+		p := newTestPool(2, 10, processorFunc(func(ctx context.Context, logger *slog.Logger, task Task) (Result, error) {
+			calls.enter()
+			defer calls.leave()
+			return slowAssign(ctx, logger, task)
+		}))
+		p.MaxRetries = 10
+		p.RetryBackoff = time.Millisecond
+		p.Start()
+
+		p.Submit(NewTask("Rider1", "Driver1"))
+		p.Submit(NewTask("Rider2", "Driver1"))
+		results, _ := p.Wait()
+
+		if n := calls.max(); n != 1 {
+			t.Errorf("%d tasks for Driver1 ran at once, want 1", n)
+		}
+		if len(results) != 2 {
+			t.Errorf("got %d results, want both riders assigned in turn; failures: %v", len(results), p.Failures())
+		}
+	})
+}
+
+func TestMatcherPairsNearestDriver(t *testing.T) {
+	m := NewMatcher()
+	m.AddRider(Rider{Name: "Alice", Location: Location{Lat: 40.0, Lng: -74.0}})
+	m.AddRider(Rider{Name: "Bob", Location: Location{Lat: 41.0, Lng: -74.0}})
+	m.AddRider(Rider{Name: "Carol", Location: Location{Lat: 42.0, Lng: -74.0}})
+	m.AddDriver(Driver{Name: "NearCarol", Location: Location{Lat: 42.01, Lng: -74.0}})
+	m.AddDriver(Driver{Name: "NearAlice", Location: Location{Lat: 40.01, Lng: -74.0}})
+	m.AddDriver(Driver{Name: "NearBob", Location: Location{Lat: 41.01, Lng: -74.0}})
+
+	tasks := m.Match()
+	got := make(map[string]string)
+	for _, task := range tasks {
+		got[task.Rider] = task.Driver
+	}
+	want := map[string]string{"Alice": "NearAlice", "Bob": "NearBob", "Carol": "NearCarol"}
+	if !maps.Equal(got, want) {
+		t.Errorf("pairs = %v, want %v", got, want)
+	}
+	if len(tasks) > 0 && (tasks[0].RiderLat != 40.0 || tasks[0].DriverLat != 40.01) {
+		t.Errorf("first task coordinates = %+v, want the matched rider's and driver's", tasks[0])
+	}
+	if more := m.Match(); len(more) != 0 {
+		t.Errorf("second Match() = %v, want nothing left to pair", more)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	if testing.Short() {
+		t.Skip("takes 5s")
+	}
+	p := newTestPool(4, 10, processorFunc(assign))
+	p.RateLimit = 2
+	p.Start()
+
+	start := time.Now()
+	for _, task := range demoTasks() {
+		p.Submit(task)
+	}
+	results, _ := p.Wait()
+	elapsed := time.Since(start)
+
+	if len(results) != 10 {
+		t.Errorf("got %d results, want all 10 tasks to wait their turn", len(results))
+	}
+	if elapsed < 4500*time.Millisecond {
+		t.Errorf("10 tasks at 2/sec took %v, want about 5s", elapsed)
+	}
+}
+
+// waitForGoroutines waits up to a second for the number of goroutines to
+// drop back to n, failing the test if it does not.
+func waitForGoroutines(t *testing.T, n int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > n && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if got := runtime.NumGoroutine(); got > n {
+		t.Errorf("%d goroutines still running, want at most %d", got, n)
+	}
+}
+
+func TestProgressReporterStopsAfterWait(t *testing.T) {
+	before := runtime.NumGoroutine()
+	p := newTestPool(2, 10, processorFunc(assign))
+	p.Start()
+	p.StartProgressReporter(time.Hour)
+	p.Submit(NewTask("Rider1", "Driver1"))
+
+	done := make(chan struct{})
+	go func() {
+		p.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Wait blocked on the progress reporter")
+	}
+	waitForGoroutines(t, before)
+}
+
+func TestCancelQueuedTask(t *testing.T) {
+	p := newTestPool(2, 10, processorFunc(assign))
+	p.Start()
+	p.Pause()
+	tasks := demoTasks()
+	for _, task := range tasks {
+		p.Submit(task)
+	}
+	rider5 := tasks[4]
+	if !p.CancelTask(rider5.ID) {
+		t.Fatalf("CancelTask(%q) = false for a queued task", rider5.ID)
+	}
+	if p.CancelTask(rider5.ID) {
+		t.Errorf("CancelTask(%q) = true a second time", rider5.ID)
+	}
+	p.Resume()
+	results, _ := p.Wait()
+
+	if len(results) != 9 {
+		t.Errorf("got %d results, want 9", len(results))
+	}
+	for _, r := range results {
+		if r.Rider == "Rider5" {
+			t.Errorf("cancelled Rider5 produced result %v", r)
+		}
+	}
+	if c := p.Cancelled(); len(c) != 1 || c[0].ID != rider5.ID {
+		t.Errorf("Cancelled() = %v, want just Rider5", c)
+	}
+	if len(p.Failures()) != 0 {
+		t.Errorf("cancellation recorded as failures: %v", p.Failures())
+	}
+}
+
+func TestCancelRunningTask(t *testing.T) {
+	started := make(chan string, 1)
+	p := newTestPool(1, 10, blockingProcessor(started, nil))
+	p.Start()
+	task := NewTask("Rider1", "Driver1")
+	p.Submit(task)
+	<-started
+
+	if !p.CancelTask(task.ID) {
+		t.Fatal("CancelTask() = false for a running task")
+	}
+	results, _ := p.Wait()
+	if len(results) != 0 || len(p.Cancelled()) != 1 {
+		t.Errorf("results = %v, cancelled = %v; want the task cancelled", results, p.Cancelled())
+	}
+}
+
+func TestSubmitAfterShutdown(t *testing.T) {
+	p := newTestPool(2, 10, processorFunc(assign))
+	p.Start()
+	p.Shutdown(true)
+
+	if err := p.Submit(NewTask("Rider1", "Driver1")); !errors.Is(err, ErrPoolClosed) {
+		t.Errorf("Submit after Shutdown = %v, want ErrPoolClosed", err)
+	}
+	if p.TrySubmit(NewTask("Rider2", "Driver2")) {
+		t.Error("TrySubmit after Shutdown = true")
+	}
+	if m := p.Metrics(); m.Submitted != 0 {
+		t.Errorf("Submitted = %d, want rejected tasks uncounted", m.Submitted)
+	}
+}
+
+func TestWeightedRoundRobinFollowsWeights(t *testing.T) {
+	drivers := []Driver{{Name: "Sedan", Weight: 1}, {Name: "SUV", Weight: 2}, {Name: "Van", Weight: 3}, {Name: "Unset"}}
+	s := NewWeightedRoundRobinStrategy()
+
+	const rounds = 7000
+	counts := make(map[string]int)
+	for range rounds {
+		d, ok := s.Select(Rider{Name: "Rider"}, drivers)
+		if !ok {
+			t.Fatal("Select() found no driver")
+		}
+		counts[d.Name]++
+	}
+
+	totalWeight := 7 // A missing weight counts as one
+	for _, d := range drivers {
+		want := float64(rounds*max(d.Weight, 1)) / float64(totalWeight)
+		if got := float64(counts[d.Name]); math.Abs(got-want) > want*0.05 {
+			t.Errorf("%s picked %v times, want about %v", d.Name, got, want)
+		}
+	}
+}
+
+func TestMatcherWithWeightedStrategy(t *testing.T) {
+	s := NewWeightedRoundRobinStrategy() // Shared, so its running scores carry over
+	counts := make(map[string]int)
+	for range 400 {
+		m := NewMatcherWithStrategy(s)
+		m.AddDriver(Driver{Name: "Light", Weight: 1})
+		m.AddDriver(Driver{Name: "Heavy", Weight: 3})
+		m.AddRider(Rider{Name: "Rider"})
+		for _, task := range m.Match() {
+			counts[task.Driver]++
+		}
+	}
+	if counts["Heavy"] != 300 || counts["Light"] != 100 {
+		t.Errorf("Heavy:Light = %d:%d, want 300:100", counts["Heavy"], counts["Light"])
+	}
+}
+
+func TestHTTPSubmitAndResults(t *testing.T) {
+	p := newTestPool(2, 10, processorFunc(assign))
+	p.Start()
+	defer p.Shutdown(true)
+	srv := httptest.NewServer(p.Handler())
+	defer srv.Close()
+
+	resp, err := http.Post(srv.URL+"/tasks", "application/json", strings.NewReader(`{"rider": "Rider1", "driver": "Driver1"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var accepted struct{ ID string }
+	json.NewDecoder(resp.Body).Decode(&accepted)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted || accepted.ID == "" {
+		t.Fatalf("POST /tasks = %d with ID %q, want 202 and the task ID", resp.StatusCode, accepted.ID)
+	}
+
+	var results []resultOutput
+	for deadline := time.Now().Add(time.Second); len(results) == 0 && time.Now().Before(deadline); {
+		resp, err := http.Get(srv.URL + "/results")
+		if err != nil {
+			t.Fatal(err)
+		}
+		json.NewDecoder(resp.Body).Decode(&results)
+		resp.Body.Close()
+	}
+	if len(results) != 1 || results[0].TaskID != accepted.ID || results[0].Rider != "Rider1" || results[0].Driver != "Driver1" {
+		t.Errorf("GET /results = %+v, want the posted task", results)
+	}
+
+	resp, err = http.Post(srv.URL+"/tasks", "application/json", strings.NewReader(`{"rider": "Rider2"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("POST /tasks without a driver = %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestPastDeadlineTaskExpires(t *testing.T) {
+	var ranStale atomic.Bool
+	p := newTestPool(1, 10, processorFunc(func(ctx context.Context, logger *slog.Logger, task Task) (Result, error) {
+		ranStale.Store(ranStale.Load() || task.Rider == "Rider1")
+		return assign(ctx, logger, task)
+	}))
+	p.Start()
+	stale := NewTask("Rider1", "Driver1")
+	stale.Deadline = time.Now().Add(-time.Minute)
+	p.Submit(stale)
+	p.Submit(NewTask("Rider2", "Driver2")) // No deadline, so never expires
+	results, _ := p.Wait()
+
+	if e := p.Expired(); len(e) != 1 || e[0].ID != stale.ID {
+		t.Errorf("Expired() = %v, want the stale task", e)
+	}
+	if len(results) != 1 || results[0].Rider != "Rider2" {
+		t.Errorf("results = %v, want only Rider2", results)
+	}
+	if status, _ := p.Status(stale.ID); status != StatusExpired {
+		t.Errorf("stale task status = %v, want expired", status)
+	}
+	if m := p.Metrics(); m.Expired != 1 || m.Failed != 0 {
+		t.Errorf("metrics = %+v, want one expiry and no failures", m)
+	}
+	if ranStale.Load() {
+		t.Error("the stale task was processed")
+	}
+}
+
+func TestRoundRobinSpreadsEvenly(t *testing.T) {
+	const workers, tasks = 4, 200
+	p := newTestPool(workers, 10, processorFunc(assign))
+	p.RoundRobin = true
+	p.Start()
+	for i := range tasks {
+		p.Submit(NewTask(fmt.Sprintf("Rider%d", i), fmt.Sprintf("Driver%d", i)))
+	}
+	p.Wait()
+
+	counts := p.WorkerTaskCounts()
+	if len(counts) != workers {
+		t.Fatalf("counts for %d workers, want %d: %v", len(counts), workers, counts)
+	}
+	mean := tasks / workers
+	for id, n := range counts {
+		if n < mean-1 || n > mean+1 {
+			t.Errorf("worker %d handled %d tasks, want %d±1", id, n, mean)
+		}
+	}
+}
+
+func TestPoolContextCancelAbortsSleep(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := NewWorkerPoolWithLogger(ctx, 1, 1, DiscardLogger())
+	p.Start()
+	p.Submit(NewTask("Rider1", "Driver1")) // Sleeps defaultProcessDelay
+	time.AfterFunc(20*time.Millisecond, cancel)
+
+	start := time.Now()
+	results, _ := p.Wait()
+	if elapsed := time.Since(start); elapsed >= defaultProcessDelay/2 {
+		t.Errorf("Wait took %v after the pool's context was cancelled, want well under %v", elapsed, defaultProcessDelay)
+	}
+	if len(results) != 0 {
+		t.Errorf("results = %v, want none from the aborted task", results)
+	}
+}
+
+func TestTrySubmitFullBuffer(t *testing.T) {
+	const buffer = 3
+	p := newTestPool(1, buffer, processorFunc(assign))
+	p.Start()
+	p.Pause()
+	for i := range buffer {
+		if !p.TrySubmit(NewTask(fmt.Sprintf("Rider%d", i), "Driver1")) {
+			t.Fatalf("TrySubmit #%d = false with room in the buffer", i+1)
+		}
+	}
+	if p.TrySubmit(NewTask("RiderX", "Driver1")) {
+		t.Error("TrySubmit = true with the buffer full")
+	}
+	p.Resume()
+	if results, _ := p.Wait(); len(results) != buffer {
+		t.Errorf("%d results, want %d", len(results), buffer)
+	}
+}
+
+func TestWaitTimeoutWithTooFewSignals(t *testing.T) {
+	p := newTestPool(3, 10, processorFunc(assign))
+	p.Start()
+	p.Submit(TerminationSignal())
+
+	err := p.WaitTimeout(50 * time.Millisecond)
+	if !errors.Is(err, ErrWaitTimeout) {
+		t.Fatalf("WaitTimeout() = %v, want ErrWaitTimeout", err)
+	}
+	if !strings.Contains(err.Error(), "2 still running") {
+		t.Errorf("WaitTimeout() = %q, want it to count the two workers left", err)
+	}
+
+	p.Submit(TerminationSignal())
+	p.Submit(TerminationSignal())
+	if err := p.WaitTimeout(time.Second); err != nil {
+		t.Errorf("WaitTimeout() after signalling every worker = %v, want nil", err)
+	}
+}
+
+func TestDedupeRejectsRepeatRider(t *testing.T) {
+	p := newTestPool(2, 10, processorFunc(assign))
+	p.Dedupe = true
+	p.Start()
+	if err := p.Submit(NewTask("Rider1", "Driver1")); err != nil {
+		t.Fatalf("first Submit() = %v", err)
+	}
+	if err := p.Submit(NewTask("Rider1", "Driver2")); !errors.Is(err, ErrDuplicateTask) {
+		t.Errorf("second Submit() for the same rider = %v, want ErrDuplicateTask", err)
+	}
+	if results, _ := p.Wait(); len(results) != 1 || results[0].Driver != "Driver1" {
+		t.Errorf("results = %v, want a single assignment to Driver1", results)
+	}
+}
+
+func TestSurgeMultiplierRisesWithQueue(t *testing.T) {
+	p := newTestPool(2, 10, processorFunc(assign))
+	p.Start()
+	p.Pause()
+	if m := p.SurgeMultiplier(); m != 1.0 {
+		t.Errorf("SurgeMultiplier() with an empty queue = %v, want 1.0", m)
+	}
+	for i := range 4 {
+		p.Submit(NewTask(fmt.Sprintf("Rider%d", i), "Driver1"))
+	}
+	// Four waiting riders over two workers is twice the default threshold.
+	if m := p.SurgeMultiplier(); m != 2.0 {
+		t.Errorf("SurgeMultiplier() with 4 queued on 2 workers = %v, want 2.0", m)
+	}
+	p.MaxSurge = 1.5
+	if m := p.SurgeMultiplier(); m != 1.5 {
+		t.Errorf("SurgeMultiplier() = %v, want it capped at MaxSurge 1.5", m)
+	}
+	p.Resume()
+	p.Wait()
+}
+
+func TestSharedRegistryAcrossPools(t *testing.T) {
+	registry := NewDriverRegistry()
+	started, release := make(chan string, 1), make(chan struct{})
+	first := newTestPool(1, 10, blockingProcessor(started, release))
+	first.Drivers = registry
+	second := newTestPool(1, 10, processorFunc(assign))
+	second.Drivers = registry
+	first.Start()
+	second.Start()
+
+	first.Submit(NewTask("Rider1", "Driver1"))
+	<-started
+	second.Submit(NewTask("Rider2", "Driver1"))
+	secondResults, _ := second.Wait()
+	close(release)
+	firstResults, _ := first.Wait()
+
+	if len(firstResults)+len(secondResults) != 1 {
+		t.Errorf("results = %v and %v, want Driver1 assigned once across both pools", firstResults, secondResults)
+	}
+	var busy *DriverBusyError
+	if f := second.Failures(); len(f) != 1 || !errors.As(f[0].Err, &busy) || busy.Driver != "Driver1" {
+		t.Errorf("second pool failures = %v, want a DriverBusyError for Driver1", f)
+	}
+	if registry.Busy("Driver1") {
+		t.Error("Driver1 still busy after both pools finished")
+	}
+}
+
+func TestShutdownWithTimeoutAbortsSlowTasks(t *testing.T) {
+	started := make(chan string, 6)
+	p := newTestPool(2, 10, blockingProcessor(started, nil)) // Never released
+	p.Start()
+	for i := range 6 {
+		p.Submit(NewTask(fmt.Sprintf("Rider%d", i), fmt.Sprintf("Driver%d", i)))
+	}
+	<-started
+	<-started
+
+	start := time.Now()
+	undone := p.ShutdownWithTimeout(50 * time.Millisecond)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("ShutdownWithTimeout took %v, want it to give up after about 50ms", elapsed)
+	}
+	if undone < 2 || undone > 6 {
+		t.Errorf("ShutdownWithTimeout() = %d undone, want the 2 aborted plus any still queued", undone)
+	}
+	for _, f := range p.Failures() {
+		if !errors.Is(f.Err, ErrPoolShutdown) {
+			t.Errorf("task %s failed with %v, want ErrPoolShutdown", f.Task.ID, f.Err)
+		}
+	}
+}
+
+func TestMaxRetainedResultsKeepsNewest(t *testing.T) {
+	p := newTestPool(1, 100, processorFunc(assign)) // One worker, so results arrive in order
+	p.MaxRetainedResults = 10
+	p.Start()
+	for i := range 100 {
+		p.Submit(NewTask(fmt.Sprintf("Rider%d", i), "Driver1"))
+	}
+	results, _ := p.Wait()
+
+	if len(results) != 10 {
+		t.Fatalf("%d results retained, want 10", len(results))
+	}
+	for i, r := range results {
+		if want := fmt.Sprintf("Rider%d", 90+i); r.Rider != want {
+			t.Errorf("results[%d] = %s, want %s", i, r.Rider, want)
+		}
+	}
+	if m := p.Metrics(); m.Processed() != 100 {
+		t.Errorf("metrics count %d processed, want all 100", m.Processed())
+	}
+}
+
+func TestTerminationSignalsWaitForTasks(t *testing.T) {
+	const workers, tasks = 2, 10
+	p := newTestPool(workers, 20, processorFunc(assign))
+	p.Start()
+	p.Pause() // Queue everything first so signals sit among the tasks
+	for i := range tasks {
+		p.Submit(NewTask(fmt.Sprintf("Rider%d", i), fmt.Sprintf("Driver%d", i)))
+		if i%5 == 0 {
+			p.Submit(TerminationSignal())
+		}
+	}
+	p.Resume()
+
+	if err := p.WaitTimeout(time.Second); err != nil {
+		t.Fatalf("WaitTimeout() = %v, want every worker stopped by its signal", err)
+	}
+	if results := p.Results(); len(results) != tasks {
+		t.Errorf("%d tasks completed before the workers stopped, want all %d", len(results), tasks)
+	}
+}
+
+func TestWriteResultsCSVGolden(t *testing.T) {
+	clock := NewFakeClock(time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC))
+	p := newTestPool(1, 10, processorFunc(func(ctx context.Context, logger *slog.Logger, task Task) (Result, error) {
+		clock.Advance(250 * time.Millisecond)
+		return assign(ctx, logger, task)
+	}))
+	p.Clock = clock
+	p.Start()
+	p.Submit(NewTask("Alice", "Driver1"))
+	p.Submit(NewTask("Doe, Jane", `Bob "The Cab" Smith`))
+	p.Wait()
+
+	var got strings.Builder
+	if err := p.WriteResultsCSV(&got); err != nil {
+		t.Fatal(err)
+	}
+	want, err := os.ReadFile("testdata/results.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.String() != string(want) {
+		t.Errorf("WriteResultsCSV wrote:\n%s\nwant:\n%s", got.String(), want)
+	}
+}
+
+func TestPauseHoldsTasksUntilResume(t *testing.T) {
+	var processed atomic.Int32
+	p := newTestPool(2, 10, processorFunc(func(ctx context.Context, logger *slog.Logger, task Task) (Result, error) {
+		processed.Add(1)
+		return assign(ctx, logger, task)
+	}))
+	p.Start()
+	p.Pause()
+	for i := range 5 {
+		p.Submit(NewTask(fmt.Sprintf("Rider%d", i), fmt.Sprintf("Driver%d", i)))
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := processed.Load(); n != 0 {
+		t.Fatalf("%d tasks processed while paused, want none", n)
+	}
+
+	p.Resume()
+	if results, _ := p.Wait(); len(results) != 5 {
+		t.Errorf("%d results after Resume, want 5", len(results))
+	}
+}
+
+func TestPanicPolicy(t *testing.T) {
+	panicky := processorFunc(func(ctx context.Context, logger *slog.Logger, task Task) (Result, error) {
+		if task.Rider == "Bomb" {
+			panic("boom")
+		}
+		return assign(ctx, logger, task)
+	})
+
+	t.Run("recover", func(t *testing.T) {
+		p := newTestPool(1, 10, panicky)
+		p.Start()
+		p.Submit(NewTask("Bomb", "Driver1"))
+		p.Submit(NewTask("Rider1", "Driver2"))
+		results, _ := p.Wait()
+
+		if len(results) != 1 || results[0].Rider != "Rider1" {
+			t.Errorf("results = %v, want the worker to carry on with Rider1", results)
+		}
+		if f := p.Failures(); len(f) != 1 || failureReason(f[0].Err) != FailurePanic {
+			t.Errorf("failures = %v, want the panic recorded", f)
+		}
+	})
+
+	t.Run("propagate", func(t *testing.T) {
+		// The re-panic happens on a worker goroutine and kills the process,
+		// so run the pool in a child copy of the test binary.
+		if os.Getenv("PANIC_POLICY_CHILD") == "1" {
+			p := newTestPool(1, 10, panicky)
+			p.PanicPolicy = PanicPropagate
+			p.Start()
+			p.Submit(NewTask("Bomb", "Driver1"))
+			p.Wait()
+			return
+		}
+		cmd := exec.Command(os.Args[0], "-test.run=^TestPanicPolicy$/^propagate$")
+		cmd.Env = append(os.Environ(), "PANIC_POLICY_CHILD=1")
+		out, err := cmd.CombinedOutput()
+		var exit *exec.ExitError
+		if !errors.As(err, &exit) {
+			t.Fatalf("child exited with %v, want a crash; output:\n%s", err, out)
+		}
+		if !strings.Contains(string(out), "panic: boom") {
+			t.Errorf("child output lacks the original panic:\n%s", out)
+		}
+	})
+}
+
+func TestMatcherPoolsNearbyRiders(t *testing.T) {
+	m := NewMatcher()
+	m.PoolCapacity = 2
+	m.AddRider(Rider{Name: "Alice", Location: Location{Lat: 40.0, Lng: -74.0}})
+	m.AddRider(Rider{Name: "Far", Location: Location{Lat: 45.0, Lng: -74.0}})
+	m.AddRider(Rider{Name: "Ann", Location: Location{Lat: 40.001, Lng: -74.0}})
+	m.AddRider(Rider{Name: "Amy", Location: Location{Lat: 40.002, Lng: -74.0}}) // Over capacity
+	m.AddDriver(Driver{Name: "Driver1", Location: Location{Lat: 40.01, Lng: -74.0}})
+
+	tasks := m.Match()
+	if len(tasks) != 1 {
+		t.Fatalf("Match() = %v, want one pooled task", tasks)
+	}
+	if got := tasks[0].AllRiders(); !slices.Equal(got, []string{"Alice", "Ann"}) || tasks[0].Driver != "Driver1" {
+		t.Fatalf("pooled task has riders %v for %s, want Alice and Ann for Driver1", got, tasks[0].Driver)
+	}
+
+	p := newTestPool(1, 10, processorFunc(assign))
+	p.Start()
+	p.Submit(tasks[0])
+	if results, _ := p.Wait(); len(results) != 1 || !slices.Equal(results[0].Riders, []string{"Ann"}) {
+		t.Errorf("results = %v, want one assignment carrying co-rider Ann", results)
+	}
+
+	m.AddDriver(Driver{Name: "Driver2", Location: Location{Lat: 40.01, Lng: -74.0}})
+	// Amy was left waiting, but is too far from Far to share that ride
+	if more := m.Match(); len(more) != 1 || more[0].Rider != "Far" || len(more[0].Riders) != 0 {
+		t.Errorf("second Match() = %v, want Far riding alone", more)
+	}
+}
+
+func TestRestartKeepsQueuedTasks(t *testing.T) {
+	const tasks = 50
+	var mu sync.Mutex
+	runs := make(map[string]int)
+	p := newTestPool(2, tasks, processorFunc(func(ctx context.Context, logger *slog.Logger, task Task) (Result, error) {
+		mu.Lock()
+		runs[task.Rider]++
+		mu.Unlock()
+		return slowAssign(ctx, logger, task)
+	}))
+	p.Start()
+	for i := range tasks {
+		p.Submit(NewTask(fmt.Sprintf("Rider%d", i), fmt.Sprintf("Driver%d", i)))
+	}
+	for p.Metrics().Processed() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	p.Restart(4)
+	if n := p.NumWorkers(); n != 4 {
+		t.Errorf("%d workers after Restart(4), want 4", n)
+	}
+	results, _ := p.Wait()
+
+	if len(results) != tasks {
+		t.Errorf("%d results, want %d; failures: %v", len(results), tasks, p.Failures())
+	}
+	for i := range tasks {
+		if n := runs[fmt.Sprintf("Rider%d", i)]; n != 1 {
+			t.Errorf("Rider%d ran %d times, want once", i, n)
+		}
+	}
+}
+
+func TestIdleTimeoutShutsPoolDown(t *testing.T) {
+	p := newTestPool(2, 10, processorFunc(slowAssign))
+	p.IdleTimeout = 30 * time.Millisecond
+	p.Start()
+	for i := range 4 {
+		p.Submit(NewTask(fmt.Sprintf("Rider%d", i), fmt.Sprintf("Driver%d", i)))
+	}
+
+	if err := p.WaitTimeout(time.Second); err != nil {
+		t.Fatalf("WaitTimeout() = %v, want the idle pool to have stopped its workers", err)
+	}
+	if results := p.Results(); len(results) != 4 {
+		t.Errorf("%d results, want all 4 finished before the idle shutdown", len(results))
+	}
+	if err := p.Submit(NewTask("Late", "Driver1")); !errors.Is(err, ErrPoolClosed) {
+		t.Errorf("Submit() after idle shutdown = %v, want ErrPoolClosed", err)
+	}
+}
+
+func TestSubmitGroupsGetOwnResults(t *testing.T) {
+	p := newTestPool(3, 20, processorFunc(slowAssign))
+	p.Start()
+	p.Pause() // Hold both groups in the queue together
+
+	got := make(chan []string, 2)
+	riders := func(results []Result) []string {
+		names := make([]string, len(results))
+		for i, r := range results {
+			names[i] = r.Rider
+		}
+		return names
+	}
+	var submitters sync.WaitGroup
+	for _, group := range []string{"A", "B"} {
+		submitters.Add(1)
+		go func() {
+			defer submitters.Done()
+			var tasks []Task
+			for i := range 4 {
+				tasks = append(tasks, NewTask(fmt.Sprintf("%s%d", group, i), fmt.Sprintf("Driver%s%d", group, i)))
+			}
+			p.SubmitGroup(tasks, func(results []Result) { got <- riders(results) })
+		}()
+	}
+	submitters.Wait()
+	p.Resume()
+
+	want := map[string][]string{"A": {"A0", "A1", "A2", "A3"}, "B": {"B0", "B1", "B2", "B3"}}
+	for range 2 {
+		select {
+		case names := <-got:
+			if len(names) == 0 {
+				t.Error("group callback got no results")
+				continue
+			}
+			group := names[0][:1]
+			if !slices.Equal(names, want[group]) {
+				t.Errorf("group callback got %v, want exactly one group's riders in order", names)
+			}
+			delete(want, group)
+		case <-time.After(time.Second):
+			t.Fatal("group callback never fired")
+		}
+	}
+	p.Wait()
+}
+
+func TestFailuresByReason(t *testing.T) {
+	errFlaky := errors.New("flaky")
+	p := newTestPool(1, 20, processorFunc(func(ctx context.Context, logger *slog.Logger, task Task) (Result, error) {
+		switch task.Rider {
+		case "Error":
+			return Result{}, errNoShow
+		case "Panic":
+			panic("boom")
+		case "Timeout":
+			<-ctx.Done()
+			return Result{}, context.Cause(ctx)
+		case "Retry1", "Retry2":
+			if task.Retries == 0 {
+				return Result{}, errFlaky
+			}
+		}
+		return assign(ctx, logger, task)
+	}))
+	p.TaskTimeout = 20 * time.Millisecond
+	p.MaxRetries = 1
+	p.RetryBackoff = time.Millisecond
+	p.RetryPolicy = func(err error) bool { return errors.Is(err, errFlaky) }
+	p.RetryQueueSize = 1 // Retry2's retry pushes out Retry1's
+	p.Acceptor = acceptorFunc(func(_ context.Context, r Result) bool { return r.Rider != "Rejected" })
+	p.Start()
+	p.Pause()
+
+	expired := NewTask("Expired", "Driver4")
+	expired.Deadline = time.Now().Add(-time.Minute)
+	cancelled := NewTask("Cancelled", "Driver5")
+	for _, task := range []Task{
+		NewTask("Error", "Driver1"),
+		NewTask("Panic", "Driver2"),
+		NewTask("Timeout", "Driver3"),
+		expired,
+		cancelled,
+		NewTask("Rejected", "Driver6"),
+		NewTask("", "Driver7"), // Invalid
+		NewTask("Retry1", "Driver8"),
+		NewTask("Retry2", "Driver9"),
+		NewTask("Fine", "Driver10"),
+	} {
+		p.Submit(task)
+	}
+	p.CancelTask(cancelled.ID)
+	p.Resume()
+	results, _ := p.Wait()
+
+	want := map[FailureReason]int{
+		FailureError:             1,
+		FailurePanic:             1,
+		FailureTimeout:           1,
+		FailureExpired:           1,
+		FailureCancelled:         1,
+		FailureDriverUnavailable: 1,
+		FailureInvalid:           1,
+		FailureRetryDropped:      1,
+	}
+	if got := p.FailuresByReason(); !maps.Equal(got, want) {
+		t.Errorf("FailuresByReason() = %v, want %v", got, want)
+	}
+	if len(results) != 2 {
+		t.Errorf("results = %v, want Fine and Retry2's retry", results)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	badCoords := NewTask("Rider3", "Driver3")
+	badCoords.RiderLat = 95
+	late := NewTask("Rider4", "Driver4")
+	late.Deadline = time.Now().Add(-time.Minute)
+	tasks := []Task{
+		NewTask("Rider1", "Driver1"),
+		NewTask("", "Driver2"),
+		badCoords,
+		late,
+		TerminationSignal(),
+		NewTask("Rider5", ""),
+	}
+
+	errs := Validate(tasks)
+	wants := []struct{ task, problem string }{
+		{"task 1 ", "missing rider"},
+		{"task 2 ", "rider coordinates"},
+		{"task 3 ", "has passed"},
+		{"task 5 ", "missing driver"},
+	}
+	if len(errs) != len(wants) {
+		t.Fatalf("Validate() = %v, want %d errors", errs, len(wants))
+	}
+	for i, want := range wants {
+		if msg := errs[i].Error(); !strings.Contains(msg, want.task) || !strings.Contains(msg, want.problem) {
+			t.Errorf("error %d = %q, want it to mention %q and %q", i, msg, want.task, want.problem)
+		}
+	}
+
+	var ran atomic.Bool
+	p := newTestPool(1, 10, processorFunc(func(ctx context.Context, logger *slog.Logger, task Task) (Result, error) {
+		ran.Store(true)
+		return assign(ctx, logger, task)
+	}))
+	p.DryRun = true
+	p.Start()
+	for _, task := range tasks[:4] {
+		p.Submit(task)
+	}
+	results, _ := p.Wait()
+	if ran.Load() {
+		t.Error("DryRun called the processor")
+	}
+	if len(results) != 1 || results[0].Rider != "Rider1" {
+		t.Errorf("dry-run results = %v, want a pseudo-result for the valid task only", results)
+	}
+}
+
+func TestWeightedWorkerPoolShares(t *testing.T) {
+	p := NewWeightedWorkerPool(context.Background(), []int{3, 1}, 10, DiscardLogger())
+	p.processor = processorFunc(assign)
+	p.Start()
+	for i := range 200 {
+		p.Submit(NewTask(fmt.Sprintf("Rider%d", i), fmt.Sprintf("Driver%d", i)))
+	}
+	p.Wait()
+
+	counts := p.WorkerTaskCounts()
+	if counts[1] != 150 || counts[2] != 50 {
+		t.Errorf("counts = %v, want 150 for the capacity-3 worker and 50 for the capacity-1 one", counts)
+	}
+}
+
+func TestStatusThroughLifecycle(t *testing.T) {
+	started, release := make(chan string, 1), make(chan struct{})
+	p := newTestPool(1, 10, processorFunc(func(ctx context.Context, logger *slog.Logger, task Task) (Result, error) {
+		if task.Rider == "Bad" {
+			return Result{}, errNoShow
+		}
+		return blockingProcessor(started, release).Process(ctx, logger, task)
+	}))
+	p.Start()
+	p.Pause()
+	task, bad, gone := NewTask("Rider1", "Driver1"), NewTask("Bad", "Driver2"), NewTask("Gone", "Driver3")
+	p.Submit(task)
+	p.Submit(bad)
+	p.Submit(gone)
+
+	check := func(id string, want TaskStatus) {
+		t.Helper()
+		if got, ok := p.Status(id); !ok || got != want {
+			t.Errorf("Status(%s) = %v, %v, want %v", id, got, ok, want)
+		}
+	}
+	check(task.ID, StatusQueued)
+	p.CancelTask(gone.ID)
+	check(gone.ID, StatusCancelled)
+	p.Resume()
+	<-started
+	check(task.ID, StatusRunning)
+	close(release)
+	p.Wait()
+	check(task.ID, StatusCompleted)
+	check(bad.ID, StatusFailed)
+	if _, ok := p.Status("no-such-task"); ok {
+		t.Error("Status() found a task that was never submitted")
+	}
+}
+
+func TestStartAfterHoldsTaskBack(t *testing.T) {
+	p := newTestPool(1, 10, processorFunc(assign))
+	p.Start()
+	booked := NewTask("Booked", "Driver1")
+	booked.StartAfter = time.Now().Add(200 * time.Millisecond)
+	p.Submit(booked)
+	p.Submit(NewTask("Now", "Driver2"))
+	results, _ := p.Wait()
+
+	if len(results) != 2 {
+		t.Fatalf("results = %v, want both tasks", results)
+	}
+	for _, r := range results {
+		if r.Rider == "Booked" && r.StartedAt.Before(booked.StartAfter) {
+			t.Errorf("booked task started at %v, %v before its StartAfter", r.StartedAt, booked.StartAfter.Sub(r.StartedAt))
+		}
+	}
+	// The later submission ran first because the booked one was not yet due.
+	if results[0].Rider != "Now" {
+		t.Errorf("first completion = %s, want Now", results[0].Rider)
+	}
+}
+
+func TestProcessorLoggerCarriesTaskAttrs(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, nil))
+	p := NewWorkerPoolWithProcessor(context.Background(), 1, 10, logger, processorFunc(func(ctx context.Context, logger *slog.Logger, task Task) (Result, error) {
+		logger.Info("quoting fare")
+		return assign(ctx, logger, task)
+	}))
+	p.Start()
+	task := NewTask("Rider1", "Driver1")
+	p.Submit(task)
+	p.Wait()
+
+	for line := range strings.Lines(buf.String()) {
+		var record map[string]any
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("bad log line %q: %v", line, err)
+		}
+		if record["msg"] != "quoting fare" {
+			continue
+		}
+		if record["task_id"] != task.ID || record["worker_id"] != 1.0 {
+			t.Errorf("processor log record = %v, want task_id %s and worker_id 1", record, task.ID)
+		}
+		return
+	}
+	t.Errorf("processor's log line missing from:\n%s", buf.String())
+}
+
+func TestMaxConcurrentCapsProcessCalls(t *testing.T) {
+	var calls overlap
+	p := newTestPool(8, 40, processorFunc(func(ctx context.Context, logger *slog.Logger, task Task) (Result, error) {
+		calls.enter()
+		defer calls.leave()
+		return slowAssign(ctx, logger, task)
+	}))
+	p.MaxConcurrent = 2
+	p.Start()
+	for i := range 40 {
+		p.Submit(NewTask(fmt.Sprintf("Rider%d", i), fmt.Sprintf("Driver%d", i)))
+	}
+	results, _ := p.Wait()
+
+	if n := calls.max(); n != 2 {
+		t.Errorf("up to %d Process calls overlapped, want 2", n)
+	}
+	if len(results) != 40 {
+		t.Errorf("%d results, want 40", len(results))
+	}
+}
+
+func TestNewTaskValidated(t *testing.T) {
+	for _, tc := range []struct{ rider, driver string }{{"", "Driver1"}, {"Rider1", ""}, {"", ""}} {
+		if _, err := NewTaskValidated(tc.rider, tc.driver); !errors.Is(err, ErrInvalidTask) {
+			t.Errorf("NewTaskValidated(%q, %q) error = %v, want ErrInvalidTask", tc.rider, tc.driver, err)
+		}
+	}
+	task, err := NewTaskValidated("Rider1", "Driver1")
+	if err != nil || task.Rider != "Rider1" || task.Driver != "Driver1" || task.ID == "" {
+		t.Errorf("NewTaskValidated(Rider1, Driver1) = %+v, %v, want a task with an ID", task, err)
+	}
+}
+
+func TestWorkerStatsSumToTotal(t *testing.T) {
+	p := newTestPool(4, 10, processorFunc(func(ctx context.Context, logger *slog.Logger, task Task) (Result, error) {
+		if strings.HasSuffix(task.Rider, "7") {
+			return Result{}, errNoShow
+		}
+		return slowAssign(ctx, logger, task)
+	}))
+	p.Start()
+	for i := range 30 {
+		p.Submit(NewTask(fmt.Sprintf("Rider%d", i), fmt.Sprintf("Driver%d", i)))
+	}
+	p.Wait()
+
+	stats := p.WorkerStats()
+	if len(stats) != 4 {
+		t.Fatalf("stats for %d workers, want 4", len(stats))
+	}
+	var tasks, failures int
+	for _, s := range stats {
+		tasks += s.Tasks
+		failures += s.Failures
+		if s.Busy <= 0 || s.Started.IsZero() {
+			t.Errorf("worker %d stats = %+v, want busy time and a start time", s.WorkerID, s)
+		}
+	}
+	if tasks != 30 {
+		t.Errorf("workers handled %d tasks between them, want 30", tasks)
+	}
+	if m := p.Metrics(); int64(failures) != m.Failed {
+		t.Errorf("workers recorded %d failures, want the %d in Metrics", failures, m.Failed)
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	var mu sync.Mutex
+	attempts := make(map[string]int)
+	p := newTestPool(1, 10, processorFunc(func(ctx context.Context, logger *slog.Logger, task Task) (Result, error) {
+		mu.Lock()
+		attempts[task.Rider]++
+		mu.Unlock()
+		if task.Rider == "Invalid" {
+			return Result{}, ErrInvalidTask
+		}
+		return Result{}, errNoShow
+	}))
+	p.MaxRetries = 2
+	p.RetryBackoff = time.Millisecond
+	p.RetryPolicy = func(err error) bool { return !errors.Is(err, ErrInvalidTask) }
+	p.Start()
+	p.Submit(NewTask("Invalid", "Driver1"))
+	p.Submit(NewTask("NoShow", "Driver2"))
+	p.Wait()
+
+	if n := attempts["Invalid"]; n != 1 {
+		t.Errorf("non-retryable task ran %d times, want once", n)
+	}
+	if n := attempts["NoShow"]; n != 3 {
+		t.Errorf("retryable task ran %d times, want 3 with MaxRetries 2", n)
+	}
+}
+
+func TestRetryBackoffFreesWorker(t *testing.T) {
+	var failed atomic.Bool
+	p := newTestPool(1, 10, processorFunc(func(ctx context.Context, logger *slog.Logger, task Task) (Result, error) {
+		if task.Rider == "Flaky" && !failed.Swap(true) {
+			return Result{}, errNoShow
+		}
+		return assign(ctx, logger, task)
+	}))
+	p.MaxRetries = 1
+	p.RetryBackoff = 300 * time.Millisecond
+	p.StuckThreshold = 50 * time.Millisecond
+	p.Start()
+	p.Submit(NewTask("Flaky", "Driver1"))
+	for !failed.Load() {
+		time.Sleep(time.Millisecond)
+	}
+	p.Submit(NewTask("Other", "Driver2"))
+
+	time.Sleep(100 * time.Millisecond) // Well into the backoff, past StuckThreshold
+	if h := p.Health(); !h.Healthy {
+		t.Errorf("Health() during backoff = %+v, want healthy", h)
+	}
+	results, _ := p.Wait()
+
+	riders := make([]string, len(results))
+	for i, r := range results {
+		riders[i] = r.Rider
+		if r.Rider == "Other" && r.Wait > 100*time.Millisecond {
+			t.Errorf("Other waited %v behind the retry backoff, want it run straight away", r.Wait)
+		}
+	}
+	if !slices.Equal(riders, []string{"Other", "Flaky"}) {
+		t.Errorf("results in order %v, want Other before the retried Flaky", riders)
+	}
+}
+
+func TestCollectReturnsResultsAndFailures(t *testing.T) {
+	p := newTestPool(2, 10, processorFunc(func(ctx context.Context, logger *slog.Logger, task Task) (Result, error) {
+		if strings.HasPrefix(task.Rider, "Fail") {
+			return Result{}, errNoShow
+		}
+		return assign(ctx, logger, task)
+	}))
+	p.Start()
+	for _, rider := range []string{"Ok1", "Fail1", "Ok2", "Fail2", "Ok3"} {
+		p.Submit(NewTask(rider, "Driver"+rider))
+	}
+	results, failures := p.Collect()
+
+	var ok, failed []string
+	for _, r := range results {
+		ok = append(ok, r.Rider)
+	}
+	for _, f := range failures {
+		if !errors.Is(f.Err, errNoShow) {
+			t.Errorf("failure for %s = %v, want errNoShow", f.Task.Rider, f.Err)
+		}
+		failed = append(failed, f.Task.Rider)
+	}
+	slices.Sort(ok)
+	slices.Sort(failed)
+	if !slices.Equal(ok, []string{"Ok1", "Ok2", "Ok3"}) || !slices.Equal(failed, []string{"Fail1", "Fail2"}) {
+		t.Errorf("Collect() = %v results and %v failures, want Ok1-3 and Fail1-2", ok, failed)
+	}
+
+	again, againFailures := p.Collect()
+	if len(again) != len(results) || len(againFailures) != len(failures) {
+		t.Errorf("second Collect() = %d results and %d failures, want the same as the first", len(again), len(againFailures))
+	}
+}
+
+func TestStartJitterIsSeededAndBounded(t *testing.T) {
+	const bound = 20 * time.Millisecond
+	delays := func(seed uint64) []time.Duration {
+		p := newTestPool(1, 10, processorFunc(assign))
+		p.StartJitter = bound
+		p.JitterSeed = seed
+		p.Start()
+		defer p.Shutdown(true)
+		out := make([]time.Duration, 50)
+		for i := range out {
+			out[i] = p.jitter()
+		}
+		return out
+	}
+
+	first := delays(42)
+	for i, d := range first {
+		if d < 0 || d >= bound {
+			t.Errorf("delay %d = %v, want within [0, %v)", i, d, bound)
+		}
+	}
+	if slices.Max(first) == slices.Min(first) {
+		t.Errorf("delays = %v, want them to vary", first)
+	}
+	if again := delays(42); !slices.Equal(first, again) {
+		t.Error("the same JitterSeed gave different delays")
+	}
+}
+
+func TestStreamTasksFromReader(t *testing.T) {
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(DiscardLogger()) // Skipped lines are warned about on the default logger
+
+	input := strings.Join([]string{
+		`{"rider": "Rider1", "driver": "Driver1"}`,
+		``,
+		`{"rider": "Rider2", "driver":`, // Malformed
+		`{"rider": "Rider3"}`,           // Invalid: no driver
+		`{"rider": "` + strings.Repeat("x", 100*1024) + `", "driver": "Driver4"}`, // Oversized
+		`{"rider": "Rider5", "driver": "Driver5"}`,
+	}, "\n") // No newline after the last line
+
+	var riders []string
+	err := StreamTasksFromReader(strings.NewReader(input), func(task Task) error {
+		riders = append(riders, task.Rider)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("StreamTasksFromReader() = %v, want bad lines skipped", err)
+	}
+	if !slices.Equal(riders, []string{"Rider1", "Rider5"}) {
+		t.Errorf("submitted %v, want Rider1 and Rider5", riders)
+	}
+
+	err = StreamTasksFromReader(strings.NewReader(input), func(task Task) error {
+		if task.Rider == "Rider5" {
+			return ErrPoolClosed
+		}
+		return nil
+	})
+	if !errors.Is(err, ErrPoolClosed) || !strings.Contains(err.Error(), "line 6") {
+		t.Errorf("StreamTasksFromReader() = %v, want the submit error for line 6", err)
+	}
+}
+
+func TestProgress(t *testing.T) {
+	started, release := make(chan string, 2), make(chan struct{})
+	blocking := blockingProcessor(started, release)
+	p := newTestPool(1, 10, processorFunc(func(ctx context.Context, logger *slog.Logger, task Task) (Result, error) {
+		if task.Rider == "Slow" {
+			return blocking.Process(ctx, logger, task)
+		}
+		return assign(ctx, logger, task)
+	}))
+	if got := p.Progress(); got != 0 {
+		t.Errorf("Progress() before any submission = %v, want 0", got)
+	}
+	p.Start()
+	for _, rider := range []string{"Fast1", "Fast2", "Slow", "Queued"} {
+		p.Submit(NewTask(rider, "Driver"+rider))
+	}
+	<-started // The one worker is held on Slow, with Queued behind it
+	if got := p.Progress(); got != 0.5 {
+		t.Errorf("Progress() with 2 of 4 done = %v, want 0.5", got)
+	}
+	close(release)
+	p.Wait()
+	if got := p.Progress(); got != 1 {
+		t.Errorf("Progress() after Wait = %v, want 1", got)
+	}
+}
+
+func TestOnShutdownHooksRunLastFirst(t *testing.T) {
+	var running atomic.Int32
+	p := newTestPool(2, 10, processorFunc(func(ctx context.Context, logger *slog.Logger, task Task) (Result, error) {
+		running.Add(1)
+		defer running.Add(-1)
+		return slowAssign(ctx, logger, task)
+	}))
+	var order []string
+	errFlush := errors.New("flush failed")
+	p.OnShutdown(func() error {
+		order = append(order, "first")
+		return nil
+	})
+	p.OnShutdown(func() error {
+		if n := p.NumWorkers(); n != 0 || running.Load() != 0 {
+			t.Errorf("hook ran with %d workers and %d tasks still running", n, running.Load())
+		}
+		order = append(order, "second")
+		return errFlush
+	})
+	p.Start()
+	for i := range 6 {
+		p.Submit(NewTask(fmt.Sprintf("Rider%d", i), fmt.Sprintf("Driver%d", i)))
+	}
+	_, err := p.Wait()
+
+	if !slices.Equal(order, []string{"second", "first"}) {
+		t.Errorf("hooks ran in order %v, want second then first", order)
+	}
+	if !errors.Is(err, errFlush) {
+		t.Errorf("Wait() = %v, want the hook's error", err)
+	}
+	p.Shutdown(true)
+	if len(order) != 2 {
+		t.Errorf("hooks ran %d times in total, want once each", len(order))
+	}
+}
+
+func TestRiderAffinityKeepsRiderOnOneWorker(t *testing.T) {
+	riders := []string{"Alice", "Bob", "Carol", "Dave"}
+	var mu sync.Mutex
+	workers := make(map[string]map[int]bool)
+	drivers := make(map[string][]string) // Each rider's drivers in completion order
+	p := newTestPool(4, 40, processorFunc(slowAssign))
+	p.RiderAffinity = true
+	p.OnComplete = func(r Result) {
+		mu.Lock()
+		defer mu.Unlock()
+		if workers[r.Rider] == nil {
+			workers[r.Rider] = make(map[int]bool)
+		}
+		workers[r.Rider][r.WorkerID] = true
+		drivers[r.Rider] = append(drivers[r.Rider], r.Driver)
+	}
+	p.Start()
+	for trip := range 5 {
+		for _, rider := range riders {
+			p.Submit(NewTask(rider, fmt.Sprintf("%s-Driver%d", rider, trip)))
+		}
+	}
+	p.Wait()
+
+	for _, rider := range riders {
+		if len(workers[rider]) != 1 {
+			t.Errorf("%s ran on workers %v, want one", rider, workers[rider])
+		}
+		var want []string
+		for trip := range 5 {
+			want = append(want, fmt.Sprintf("%s-Driver%d", rider, trip))
+		}
+		if !slices.Equal(drivers[rider], want) {
+			t.Errorf("%s's tasks finished in order %v, want submission order", rider, drivers[rider])
+		}
+	}
+}
+
+func TestQueuePolicies(t *testing.T) {
+	batch := func() []Task {
+		tasks := make([]Task, 5)
+		for i := range tasks {
+			tasks[i] = NewTask(fmt.Sprintf("Rider%d", i), fmt.Sprintf("Driver%d", i))
+		}
+		return tasks
+	}
+	paused := func(policy QueuePolicy) *WorkerPool {
+		p := newTestPool(1, 3, processorFunc(assign))
+		p.QueuePolicy = policy
+		p.Start()
+		p.Pause()
+		return p
+	}
+
+	t.Run("block", func(t *testing.T) {
+		p := paused(QueueBlock)
+		queued := make(chan int, 1)
+		go func() { queued <- p.SubmitBatch(batch()) }()
+		select {
+		case n := <-queued:
+			t.Fatalf("SubmitBatch returned %d with the buffer full, want it to block", n)
+		case <-time.After(30 * time.Millisecond):
+		}
+		p.Resume()
+		if n := <-queued; n != 5 {
+			t.Errorf("SubmitBatch() = %d, want 5 once workers drained the buffer", n)
+		}
+		p.Wait()
+	})
+
+	t.Run("grow", func(t *testing.T) {
+		p := paused(QueueGrow)
+		if n := p.SubmitBatch(batch()); n != 5 {
+			t.Errorf("SubmitBatch() = %d, want all 5 queued past the buffer size", n)
+		}
+		p.Resume()
+		if results, _ := p.Wait(); len(results) != 5 {
+			t.Errorf("%d results, want 5", len(results))
+		}
+	})
+
+	t.Run("reject", func(t *testing.T) {
+		p := paused(QueueReject)
+		if n := p.SubmitBatch(batch()); n != 3 {
+			t.Errorf("SubmitBatch() = %d, want 3 before the buffer filled", n)
+		}
+		if err := p.Submit(NewTask("Extra", "DriverX")); !errors.Is(err, ErrBufferFull) {
+			t.Errorf("Submit() with the buffer full = %v, want ErrBufferFull", err)
+		}
+		p.Resume()
+		if results, _ := p.Wait(); len(results) != 3 {
+			t.Errorf("%d results, want the 3 queued", len(results))
+		}
+	})
+}
+
+func TestNewWorkerPoolOptions(t *testing.T) {
+	t.Run("defaults", func(t *testing.T) {
+		p := NewWorkerPool()
+		if p.numWorkers != defaultWorkers || p.tasks.capacity != defaultBufferSize {
+			t.Errorf("workers, buffer = %d, %d, want %d, %d", p.numWorkers, p.tasks.capacity, defaultWorkers, defaultBufferSize)
+		}
+		if _, ok := p.processor.(SleepProcessor); !ok {
+			t.Errorf("processor = %T, want SleepProcessor", p.processor)
+		}
+		if p.logger != slog.Default() {
+			t.Error("logger is not slog.Default()")
+		}
+		if p.TaskTimeout != 0 || p.RateLimit != 0 || p.MaxRetries != 0 || p.Clock != nil || p.backend != nil || p.tracer != nil {
+			t.Errorf("pool = %+v, want no timeout, rate limit, retries, clock, queue or tracer", p)
+		}
+	})
+
+	t.Run("combined", func(t *testing.T) {
+		clock := NewFakeClock(time.Now())
+		logger := DiscardLogger()
+		p := NewWorkerPool(
+			WithWorkers(2),
+			WithBuffer(5),
+			WithLogger(logger),
+			WithProcessor(processorFunc(assign)),
+			WithTimeout(time.Second),
+			WithRateLimit(100),
+			WithRetries(3, time.Millisecond),
+			WithClock(clock),
+		)
+		if p.numWorkers != 2 || p.tasks.capacity != 5 || p.logger != logger {
+			t.Errorf("workers, buffer = %d, %d, want 2, 5 and the given logger", p.numWorkers, p.tasks.capacity)
+		}
+		if p.TaskTimeout != time.Second || p.RateLimit != 100 || p.MaxRetries != 3 || p.RetryBackoff != time.Millisecond || p.Clock != clock {
+			t.Errorf("timeout %v, rate limit %d, retries %d after %v, clock %v; want the options' values",
+				p.TaskTimeout, p.RateLimit, p.MaxRetries, p.RetryBackoff, p.Clock)
+		}
+	})
+
+	t.Run("later options win", func(t *testing.T) {
+		p := NewWorkerPool(WithWorkers(2), WithTimeout(time.Second), WithWorkers(3), WithTimeout(time.Minute))
+		if p.numWorkers != 3 || p.TaskTimeout != time.Minute {
+			t.Errorf("workers %d, timeout %v, want 3 and 1m", p.numWorkers, p.TaskTimeout)
+		}
+	})
+
+	t.Run("runs", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		p := NewWorkerPool(WithContext(ctx), WithWorkers(2), WithLogger(DiscardLogger()), WithProcessor(processorFunc(assign)))
+		p.Start()
+		for i := range 5 {
+			p.Submit(NewTask(fmt.Sprintf("Rider%d", i), fmt.Sprintf("Driver%d", i)))
+		}
+		if results, _ := p.Wait(); len(results) != 5 {
+			t.Errorf("%d results, want 5", len(results))
+		}
+	})
+}
+
+func TestLatencyPercentile(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	p := newTestPool(1, 100, processorFunc(func(ctx context.Context, logger *slog.Logger, task Task) (Result, error) {
+		ms, _ := strconv.Atoi(strings.TrimPrefix(task.Rider, "Rider"))
+		clock.Advance(time.Duration(ms) * time.Millisecond)
+		return assign(ctx, logger, task)
+	}))
+	p.Clock = clock
+	if got := p.LatencyPercentile(50); got != 0 {
+		t.Errorf("LatencyPercentile(50) before any completion = %v, want 0", got)
+	}
+	p.Start()
+	for _, i := range rand.Perm(100) { // Durations of 1ms to 100ms in random order
+		p.Submit(NewTask(fmt.Sprintf("Rider%d", i+1), fmt.Sprintf("Driver%d", i)))
+	}
+	p.Wait()
+
+	for _, tc := range []struct {
+		pct  float64
+		want time.Duration
+	}{
+		{50, 50 * time.Millisecond},
+		{90, 90 * time.Millisecond},
+		{99, 99 * time.Millisecond},
+		{99.5, 100 * time.Millisecond},
+		{100, 100 * time.Millisecond},
+		{0, time.Millisecond},
+		{-5, time.Millisecond},
+		{150, 100 * time.Millisecond},
+	} {
+		if got := p.LatencyPercentile(tc.pct); got != tc.want {
+			t.Errorf("LatencyPercentile(%v) = %v, want %v", tc.pct, got, tc.want)
+		}
+	}
+}
+
+func TestAgingLetsOldTaskThroughFlood(t *testing.T) {
+	// completionIndex runs a flood of high-priority tasks, each submitting
+	// the next a (simulated) second later, behind one low-priority task,
+	// and returns where the low-priority task came in the completion order.
+	completionIndex := func(agingRate float64) int {
+		const flood = 60
+		clock := NewFakeClock(time.Now())
+		var p *WorkerPool
+		var highs atomic.Int32 // High-priority tasks processed
+		p = newTestPool(1, 2*flood, processorFunc(func(ctx context.Context, logger *slog.Logger, task Task) (Result, error) {
+			clock.Advance(time.Second)
+			if task.Rider == "Low" {
+				return assign(ctx, logger, task)
+			}
+			if n := highs.Add(1); n < flood {
+				high := NewTask(fmt.Sprintf("High%d", n), "Driver")
+				high.Priority = 10
+				p.Submit(high)
+			}
+			return assign(ctx, logger, task)
+		}))
+		p.Clock = clock
+		p.AgingRate = agingRate
+		p.Start()
+		p.Pause()
+		p.Submit(NewTask("Low", "Driver"))
+		first := NewTask("High0", "Driver")
+		first.Priority = 10
+		p.Submit(first)
+		p.Resume()
+		for p.Metrics().Completed < flood {
+			time.Sleep(time.Millisecond)
+		}
+		results, _ := p.Wait()
+		return slices.IndexFunc(results, func(r Result) bool { return r.Rider == "Low" })
+	}
+
+	// With one point per second, Low outranks any High submitted more than
+	// 10 seconds after it.
+	if i := completionIndex(1); i < 0 || i > 15 {
+		t.Errorf("with aging, the low-priority task finished at position %d, want within the first 15", i)
+	}
+	if i := completionIndex(0); i != 60 {
+		t.Errorf("without aging, the low-priority task finished at position %d, want last", i)
+	}
+}
+
+func TestHealthReportsStuckWorker(t *testing.T) {
+	started, release := make(chan string, 1), make(chan struct{})
+	clock := NewFakeClock(time.Now())
+	p := newTestPool(2, 10, blockingProcessor(started, release))
+	p.Clock = clock
+	p.StuckThreshold = time.Minute
+	p.Start()
+	p.Submit(NewTask("Rider1", "Driver1"))
+	<-started
+
+	if h := p.Health(); !h.Healthy || h.Workers != 2 {
+		t.Errorf("Health() with a task just started = %+v, want healthy with 2 workers", h)
+	}
+	clock.Advance(2 * time.Minute)
+	h := p.Health()
+	if h.Healthy || len(h.Stuck) != 1 || len(h.Problems) != 1 || !strings.Contains(h.Problems[0], "stuck") {
+		t.Errorf("Health() after 2m on one task = %+v, want unhealthy with one stuck worker", h)
+	}
+	rec := httptest.NewRecorder()
+	p.HealthHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("health handler replied %d, want 503", rec.Code)
+	}
+
+	close(release)
+	p.Shutdown(true)
+	if h := p.Health(); h.Healthy {
+		t.Errorf("Health() after shutdown = %+v, want unhealthy", h)
+	}
+}
+
+func TestFailedTasksRoundTrip(t *testing.T) {
+	var outage atomic.Bool
+	outage.Store(true)
+	processor := processorFunc(func(ctx context.Context, logger *slog.Logger, task Task) (Result, error) {
+		if outage.Load() {
+			return Result{}, errNoShow
+		}
+		return assign(ctx, logger, task)
+	})
+
+	first := newTestPool(1, 10, processor)
+	first.Start()
+	pooled := NewPoolTask([]string{"Rider1", "Rider2"}, "Driver1")
+	pooled.Priority = 3
+	pooled.RiderLat, pooled.RiderLng, pooled.DriverLat, pooled.DriverLng = 40.1, -74.1, 40.2, -74.2
+	pooled.Metadata = map[string]string{"city": "NYC"}
+	first.Submit(pooled)
+	first.Submit(NewTask("Rider3", "Driver3"))
+	first.Wait()
+
+	var dump bytes.Buffer
+	if err := first.WriteFailedTasks(&dump); err != nil {
+		t.Fatal(err)
+	}
+	tasks, err := LoadFailedTasks(&dump)
+	if err != nil {
+		t.Fatalf("LoadFailedTasks() = %v", err)
+	}
+	if len(tasks) != 2 {
+		t.Fatalf("loaded %d tasks, want 2", len(tasks))
+	}
+	var got Task
+	for _, task := range tasks {
+		if task.ID == pooled.ID {
+			got = task
+		}
+	}
+	if !slices.Equal(got.AllRiders(), pooled.AllRiders()) || got.Driver != pooled.Driver || got.Priority != 3 ||
+		got.RiderLat != 40.1 || got.DriverLng != -74.2 || got.Metadata["city"] != "NYC" {
+		t.Errorf("reloaded task = %+v, want the fields of %+v", got, pooled)
+	}
+
+	outage.Store(false)
+	second := newTestPool(1, 10, processor)
+	second.Start()
+	for _, task := range tasks {
+		second.Submit(task)
+	}
+	if results, _ := second.Wait(); len(results) != 2 {
+		t.Errorf("%d results from the replay, want both tasks assigned; failures: %v", len(results), second.Failures())
+	}
+
+	if _, err := LoadFailedTasks(strings.NewReader(`[{"id": "t1", "rider": "Rider1"}]`)); !errors.Is(err, ErrInvalidTask) {
+		t.Errorf("LoadFailedTasks() with no driver = %v, want ErrInvalidTask", err)
+	}
+}
+
+func TestOrderedStreamKeepsSubmissionOrder(t *testing.T) {
+	const tasks = 12
+	p := newTestPool(4, tasks, processorFunc(func(ctx context.Context, logger *slog.Logger, task Task) (Result, error) {
+		i, _ := strconv.Atoi(strings.TrimPrefix(task.Rider, "Rider"))
+		if i == 5 {
+			return Result{}, errNoShow // Skipped without holding up the rest
+		}
+		time.Sleep(time.Duration(tasks-i) * time.Millisecond) // Later tasks finish first
+		return assign(ctx, logger, task)
+	}))
+	p.Start()
+	stream := p.OrderedStream()
+	for i := range tasks {
+		p.Submit(NewTask(fmt.Sprintf("Rider%d", i), fmt.Sprintf("Driver%d", i)))
+	}
+	go p.Wait()
+
+	var got, want []string
+	for r := range stream {
+		got = append(got, r.Rider)
+	}
+	for i := range tasks {
+		if i != 5 {
+			want = append(want, fmt.Sprintf("Rider%d", i))
+		}
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("OrderedStream emitted %v, want %v", got, want)
+	}
+}
+
+func TestCancelAllThenNewTasksRun(t *testing.T) {
+	started := make(chan string, 2)
+	blocking := blockingProcessor(started, nil) // Held until cancelled
+	p := newTestPool(2, 10, processorFunc(func(ctx context.Context, logger *slog.Logger, task Task) (Result, error) {
+		if strings.HasPrefix(task.Rider, "Old") {
+			return blocking.Process(ctx, logger, task)
+		}
+		return assign(ctx, logger, task)
+	}))
+	p.Start()
+	for i := range 5 {
+		p.Submit(NewTask(fmt.Sprintf("Old%d", i), fmt.Sprintf("OldDriver%d", i)))
+	}
+	<-started
+	<-started // Both workers busy, three tasks queued
+
+	if n := p.CancelAll(); n != 3 {
+		t.Errorf("CancelAll() = %d, want the 3 queued tasks", n)
+	}
+	for i := range 3 {
+		p.Submit(NewTask(fmt.Sprintf("New%d", i), fmt.Sprintf("NewDriver%d", i)))
+	}
+	results, _ := p.Wait()
+
+	var riders []string
+	for _, r := range results {
+		riders = append(riders, r.Rider)
+	}
+	slices.Sort(riders)
+	if !slices.Equal(riders, []string{"New0", "New1", "New2"}) {
+		t.Errorf("results = %v, want just the tasks submitted after CancelAll", riders)
+	}
+	if m := p.Metrics(); m.Cancelled != 5 {
+		t.Errorf("%d tasks cancelled, want all 5 old ones", m.Cancelled)
+	}
+}
+
+func TestHighestRatedStrategyPrefersRating(t *testing.T) {
+	rider := Rider{Name: "Alice", Location: Location{Lat: 40.0, Lng: -74.0}}
+	north := Location{Lat: 40.01, Lng: -74.0}
+	south := Location{Lat: 39.99, Lng: -74.0} // Same distance as north
+
+	for _, drivers := range [][]Driver{
+		{{Name: "Good", Location: north, Rating: 4.2}, {Name: "Best", Location: south, Rating: 4.9}},
+		{{Name: "Best", Location: south, Rating: 4.9}, {Name: "Good", Location: north, Rating: 4.2}},
+	} {
+		m := NewMatcherWithStrategy(HighestRatedStrategy{})
+		m.AddRider(rider)
+		for _, d := range drivers {
+			m.AddDriver(d)
+		}
+		tasks := m.Match()
+		if len(tasks) != 1 || tasks[0].Driver != "Best" || tasks[0].DriverRating != 4.9 {
+			t.Fatalf("Match() = %v, want Alice paired with the 4.9-rated driver", tasks)
+		}
+
+		p := newTestPool(1, 1, processorFunc(assign))
+		p.Start()
+		p.Submit(tasks[0])
+		if results, _ := p.Wait(); len(results) != 1 || results[0].Rating != 4.9 {
+			t.Errorf("results = %v, want the driver's rating recorded", results)
+		}
+	}
+
+	// Equal ratings fall back to the tie-break, nearest by default.
+	near := Driver{Name: "Near", Location: north, Rating: 4.5}
+	far := Driver{Name: "Far", Location: Location{Lat: 40.1, Lng: -74.0}, Rating: 4.5}
+	if d, _ := (HighestRatedStrategy{}).Select(rider, []Driver{far, near}); d.Name != "Near" {
+		t.Errorf("tied ratings picked %s, want the nearer driver", d.Name)
+	}
+	if d, _ := (HighestRatedStrategy{TieBreak: &RoundRobinStrategy{}}).Select(rider, []Driver{far, near}); d.Name != "Far" {
+		t.Errorf("tied ratings with a round-robin tie-break picked %s, want the first in turn", d.Name)
+	}
+}
+
+func TestRetryLaneLeavesBufferForFreshTasks(t *testing.T) {
+	started, release := make(chan string, 4), make(chan struct{})
+	blocking := blockingProcessor(started, release)
+	p := newTestPool(1, 2, processorFunc(func(ctx context.Context, logger *slog.Logger, task Task) (Result, error) {
+		if strings.HasPrefix(task.Rider, "Flaky") {
+			if task.Retries == 0 {
+				return Result{}, errNoShow
+			}
+			return blocking.Process(ctx, logger, task)
+		}
+		return assign(ctx, logger, task)
+	}))
+	p.MaxRetries = 1
+	p.RetryBackoff = time.Millisecond
+	p.RetryQueueSize = 4
+	p.Start()
+	p.Submit(NewTask("Flaky0", "Driver0"))
+	p.Submit(NewTask("Flaky1", "Driver1"))
+
+	<-started // Flaky0's retry holds the worker...
+	for p.queueLen() != 1 {
+		time.Sleep(time.Millisecond) // ...while Flaky1's waits in the retry lane
+	}
+	for i := range 2 {
+		if !p.TrySubmit(NewTask(fmt.Sprintf("Fresh%d", i), fmt.Sprintf("FreshDriver%d", i))) {
+			t.Fatalf("TrySubmit #%d = false, want the pending retry to leave the buffer free", i+1)
+		}
+	}
+	if p.TrySubmit(NewTask("Extra", "ExtraDriver")) {
+		t.Error("TrySubmit = true with the buffer full of fresh tasks")
+	}
+	close(release)
+	results, _ := p.Wait()
+
+	var order []string
+	for _, r := range results {
+		order = append(order, r.Rider)
+	}
+	if want := []string{"Flaky0", "Fresh0", "Fresh1", "Flaky1"}; !slices.Equal(order, want) {
+		t.Errorf("completion order = %v, want %v with fresh tasks ahead of the waiting retry", order, want)
+	}
+}
+
+func TestNewTaskAtCoordinates(t *testing.T) {
+	home := Location{Lat: 40.0, Lng: -74.0}
+	if _, err := NewTaskAt("Rider1", Location{Lat: 95, Lng: 190}, "Driver1", home, CoordinatesStrict); !errors.Is(err, ErrInvalidTask) {
+		t.Errorf("strict NewTaskAt() with (95, 190) = %v, want ErrInvalidTask", err)
+	}
+	// Normalizing cannot fix a NaN, so the task stays invalid for the pool to reject.
+	if nan, _ := NewTaskAt("Rider1", home, "Driver1", Location{Lat: math.NaN()}, CoordinatesNormalize); !errors.Is(validateFields(nan), ErrInvalidTask) {
+		t.Errorf("normalized task with a NaN latitude = %+v, want it still invalid", nan)
+	}
+
+	task, err := NewTaskAt("Rider1", Location{Lat: 95, Lng: 190}, "Driver1", Location{Lat: -91, Lng: -540}, CoordinatesNormalize)
+	if err != nil {
+		t.Fatalf("normalizing NewTaskAt() = %v", err)
+	}
+	if task.RiderLat != 90 || task.RiderLng != -170 || task.DriverLat != -90 || task.DriverLng != -180 {
+		t.Errorf("normalized coordinates = rider (%g, %g), driver (%g, %g), want (90, -170) and (-90, -180)",
+			task.RiderLat, task.RiderLng, task.DriverLat, task.DriverLng)
+	}
+
+	for _, tc := range []struct{ in, want Location }{
+		{Location{Lat: 45, Lng: 180}, Location{Lat: 45, Lng: -180}},
+		{Location{Lat: 45, Lng: 359}, Location{Lat: 45, Lng: -1}},
+		{Location{Lat: 45, Lng: -181}, Location{Lat: 45, Lng: 179}},
+		{Location{Lat: 45, Lng: 179.5}, Location{Lat: 45, Lng: 179.5}},
+	} {
+		if got := NormalizeLocation(tc.in); got != tc.want {
+			t.Errorf("NormalizeLocation(%v) = %v, want %v", tc.in, got, tc.want)
+		}
+	}
+}
+
+// recordingTracer is a Tracer that keeps every span it starts.
+type recordingTracer struct {
+	mu    sync.Mutex
+	spans []*recordedSpan
+}
+
+type recordedSpan struct {
+	mu     sync.Mutex
+	name   string
+	parent *recordedSpan
+	attrs  map[string]string
+	errs   []error
+	status SpanStatus
+	ended  bool
+}
+
+// spanKey is the context key under which recordingTracer stores the span.
+type spanKey struct{}
+
+func (tr *recordingTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	parent, _ := ctx.Value(spanKey{}).(*recordedSpan)
+	s := &recordedSpan{name: name, parent: parent, attrs: make(map[string]string)}
+	tr.mu.Lock()
+	tr.spans = append(tr.spans, s)
+	tr.mu.Unlock()
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+func (s *recordedSpan) SetAttributes(attrs ...slog.Attr) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, a := range attrs {
+		s.attrs[a.Key] = a.Value.String()
+	}
+}
+
+func (s *recordedSpan) RecordError(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errs = append(s.errs, err)
+}
+
+func (s *recordedSpan) SetStatus(code SpanStatus, _ string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status = code
+}
+
+func (s *recordedSpan) End() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ended = true
+}
+
+func TestTracerRecordsSpanPerTask(t *testing.T) {
+	tracer := &recordingTracer{}
+	var untraced atomic.Int32
+	p := NewWorkerPool(WithWorkers(2), WithLogger(DiscardLogger()), WithTracer(tracer),
+		WithProcessor(processorFunc(func(ctx context.Context, logger *slog.Logger, task Task) (Result, error) {
+			if ctx.Value(spanKey{}) == nil {
+				untraced.Add(1)
+			}
+			if task.Rider == "Bad" {
+				return Result{}, errNoShow
+			}
+			return assign(ctx, logger, task)
+		})))
+	p.Start()
+	parentCtx, parent := tracer.Start(context.Background(), "request")
+	good, bad := NewTask("Good", "Driver1"), NewTask("Bad", "Driver2")
+	p.SubmitContext(parentCtx, good)
+	p.Submit(bad)
+	p.Wait()
+
+	if n := untraced.Load(); n != 0 {
+		t.Errorf("%d Process calls had no span in their context", n)
+	}
+	spans := make(map[string]*recordedSpan)
+	for _, s := range tracer.spans[1:] { // After the parent
+		spans[s.attrs["task_id"]] = s
+	}
+	if len(spans) != 2 {
+		t.Fatalf("%d task spans, want one per task", len(tracer.spans)-1)
+	}
+	for _, tc := range []struct {
+		task    Task
+		status  SpanStatus
+		outcome string
+		errs    int
+		parent  *recordedSpan
+	}{
+		{good, SpanOK, "completed", 0, parent.(*recordedSpan)},
+		{bad, SpanError, "failed", 1, nil},
+	} {
+		s := spans[tc.task.ID]
+		if s == nil {
+			t.Errorf("no span for %s", tc.task.Rider)
+			continue
+		}
+		if s.name != "assign_ride" || !s.ended || s.status != tc.status || len(s.errs) != tc.errs || s.parent != tc.parent {
+			t.Errorf("%s span = %+v, want an ended assign_ride span with status %v, %d errors and the submit context's parent",
+				tc.task.Rider, s, tc.status, tc.errs)
+		}
+		if s.attrs["rider"] != tc.task.Rider || s.attrs["driver"] != tc.task.Driver || s.attrs["attempt"] != "1" ||
+			s.attrs["worker_id"] == "" || s.attrs["outcome"] != tc.outcome {
+			t.Errorf("%s span attributes = %v, want its rider, driver, worker, attempt 1 and outcome %s", tc.task.Rider, s.attrs, tc.outcome)
+		}
+	}
+}
+
+func TestSlowStreamConsumerDropsResults(t *testing.T) {
+	const n = 10
+	p := newTestPool(2, n, processorFunc(assign))
+	p.ResultTimeout = 5 * time.Millisecond
+	p.DropSlowResults = true
+	p.Start()
+	defer p.Shutdown(true)
+
+	tasks := make(chan Task, n)
+	for i := range n {
+		tasks <- NewTask(fmt.Sprintf("Rider%d", i), fmt.Sprintf("Driver%d", i))
+	}
+	close(tasks)
+	out := p.Stream(tasks)
+
+	// Nobody is receiving yet, but the workers must not stall
+	deadline := time.Now().Add(5 * time.Second)
+	for p.Metrics().Completed < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("workers stalled at %d of %d tasks behind a slow consumer", p.Metrics().Completed, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	received := len(collect(t, out, 5*time.Second))
+
+	if dropped := p.DroppedResults(); dropped == 0 || int(dropped)+received != n {
+		t.Errorf("%d results dropped and %d received, want drops accounting for every undelivered result", dropped, received)
+	}
+	if got := len(p.Results()); got != n {
+		t.Errorf("%d results recorded, want all %d despite the drops", got, n)
+	}
+}
+
+func TestSnapshotRestoreIntoNewPool(t *testing.T) {
+	started, release := make(chan string, 1), make(chan struct{})
+	first := newTestPool(1, 10, blockingProcessor(started, release))
+	first.Start()
+	ids := make(map[string]bool)
+	for i := range 6 {
+		task := NewTask(fmt.Sprintf("Rider%d", i), fmt.Sprintf("Driver%d", i))
+		if i == 5 {
+			task.Priority = 2
+		}
+		ids[task.ID] = true
+		first.Submit(task)
+	}
+	<-started // One task running, five queued
+
+	snapshot, err := first.Snapshot()
+	if err != nil {
+		t.Fatalf("Snapshot() = %v", err)
+	}
+	if len(snapshot) != 5 {
+		t.Fatalf("snapshot has %d tasks, want the 5 queued", len(snapshot))
+	}
+	close(release)
+	done, _ := first.Wait()
+
+	second := newTestPool(2, 10, processorFunc(assign))
+	second.Start()
+	if err := second.Restore(snapshot); err != nil {
+		t.Fatalf("Restore() = %v", err)
+	}
+	restored, _ := second.Wait()
+
+	if len(done) != 1 || len(restored) != 5 {
+		t.Fatalf("%d tasks finished before the snapshot and %d after, want 1 and 5", len(done), len(restored))
+	}
+	for _, r := range append(done, restored...) {
+		if !ids[r.TaskID] {
+			t.Errorf("task %s finished twice or was never submitted", r.TaskID)
+		}
+		delete(ids, r.TaskID)
+	}
+	for _, task := range snapshot {
+		if task.Rider == "Rider5" && task.Priority != 2 {
+			t.Errorf("snapshotted Rider5 has priority %d, want 2", task.Priority)
+		}
+	}
+}
+
+func TestStartupRampStaggersWorkers(t *testing.T) {
+	clock := NewFakeClock(time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC))
+	p := newTestPool(4, 10, processorFunc(assign))
+	p.Clock = clock
+	p.StartupRamp = 400 * time.Millisecond
+	p.Start()
+
+	for want := 1; want <= 4; want++ {
+		if n := p.NumWorkers(); n != want {
+			t.Fatalf("%d workers after %v, want %d", n, time.Duration(want-1)*100*time.Millisecond, want)
+		}
+		if want < 4 {
+			for clock.Waiters() == 0 {
+				time.Sleep(time.Millisecond) // Let the ramp wait for its next step
+			}
+			clock.Advance(100 * time.Millisecond)
+			for p.NumWorkers() == want {
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}
+
+	stats := p.WorkerStats()
+	for i := 1; i < len(stats); i++ {
+		if gap := stats[i].Started.Sub(stats[i-1].Started); gap != 100*time.Millisecond {
+			t.Errorf("worker %d started %v after worker %d, want 100ms", stats[i].WorkerID, gap, stats[i-1].WorkerID)
+		}
+	}
+	p.Shutdown(true)
+}
+
+func TestSummaryOfKnownRun(t *testing.T) {
+	start := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+	p := newTestPool(1, 10, processorFunc(func(ctx context.Context, logger *slog.Logger, task Task) (Result, error) {
+		clock.Advance(time.Second)
+		if task.Rider == "Fail" {
+			return Result{}, errNoShow
+		}
+		return assign(ctx, logger, task)
+	}))
+	p.Clock = clock
+	p.Start()
+	p.Pause()
+	expired := NewTask("Expired", "Driver5")
+	expired.Deadline = start.Add(-time.Minute)
+	cancelled := NewTask("Cancelled", "Driver6")
+	for _, task := range []Task{NewTask("Ok1", "Driver1"), NewTask("Ok2", "Driver2"), NewTask("Ok3", "Driver3"), NewTask("Fail", "Driver4"), expired, cancelled} {
+		p.Submit(task)
+	}
+	p.CancelTask(cancelled.ID)
+	p.Resume()
+	p.Wait()
+
+	s := p.Summary()
+	want := RunSummary{
+		Total:          6,
+		Succeeded:      3,
+		Failed:         1,
+		Cancelled:      1,
+		Expired:        1,
+		Duration:       4 * time.Second, // One simulated second per task processed
+		TasksPerSecond: 1.5,
+		WorkerTasks:    map[int]int{1: 5}, // Every task the worker picked up, the expired one included
+	}
+	if s.Total != want.Total || s.Succeeded != want.Succeeded || s.Failed != want.Failed || s.Cancelled != want.Cancelled ||
+		s.Expired != want.Expired || s.Duration != want.Duration || s.TasksPerSecond != want.TasksPerSecond || !maps.Equal(s.WorkerTasks, want.WorkerTasks) {
+		t.Errorf("Summary() = %+v, want %+v", s, want)
+	}
+	if out := s.String(); !strings.Contains(out, "6 (3 succeeded, 1 failed, 1 cancelled, 1 expired)") || !strings.Contains(out, "4s (1.5 tasks/sec)") {
+		t.Errorf("summary report =\n%s\nwant the counts and throughput", out)
+	}
+}
+
+func TestHandleSignals(t *testing.T) {
+	t.Run("first drains, second exits", func(t *testing.T) {
+		started := make(chan string, 1)
+		p := newTestPool(1, 10, blockingProcessor(started, nil)) // Only stops when aborted
+		p.Start()
+		p.Submit(NewTask("Rider1", "Driver1"))
+		<-started
+
+		sigs, done := make(chan os.Signal, 2), make(chan struct{})
+		ctx, cancel := context.WithCancel(context.Background())
+		exits := make(chan int, 1)
+		returned := make(chan struct{})
+		go func() {
+			defer close(returned)
+			p.handleSignals(sigs, done, cancel, 20*time.Millisecond, func(code int) { exits <- code })
+		}()
+
+		sigs <- os.Interrupt
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second):
+			t.Fatal("first signal did not cancel the context")
+		}
+		if err := p.WaitTimeout(time.Second); err != nil {
+			t.Fatalf("pool still running after the drain timeout: %v", err)
+		}
+		if err := p.Submit(NewTask("Late", "Driver2")); !errors.Is(err, ErrPoolClosed) {
+			t.Errorf("Submit() after the first signal = %v, want ErrPoolClosed", err)
+		}
+		if f := p.Failures(); len(f) != 1 || !errors.Is(f[0].Err, ErrPoolShutdown) {
+			t.Errorf("failures = %v, want the running task aborted by the drain timeout", f)
+		}
+		select {
+		case code := <-exits:
+			t.Fatalf("exit(%d) called after only one signal", code)
+		default:
+		}
+
+		sigs <- syscall.SIGTERM
+		select {
+		case code := <-exits:
+			if code != 1 {
+				t.Errorf("exit code = %d, want 1", code)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("second signal did not exit")
+		}
+		close(done)
+		<-returned
+	})
+
+	t.Run("done before any signal", func(t *testing.T) {
+		p := newTestPool(1, 10, processorFunc(assign))
+		p.Start()
+		defer p.Shutdown(true)
+		done := make(chan struct{})
+		close(done)
+		var cancelled atomic.Bool
+		p.handleSignals(make(chan os.Signal), done, func() { cancelled.Store(true) }, time.Second, func(int) { t.Error("exit called") })
+		if cancelled.Load() {
+			t.Error("cancel called without a signal")
+		}
+	})
+}
+
+func TestSLAViolationsFlagsLateRiders(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	p := newTestPool(1, 10, processorFunc(func(ctx context.Context, logger *slog.Logger, task Task) (Result, error) {
+		clock.Advance(time.Second) // Each ride holds up the queue behind it for a second
+		return assign(ctx, logger, task)
+	}))
+	p.Clock = clock
+	p.Start()
+	p.Pause()
+	for i := range 5 {
+		p.Submit(NewTask(fmt.Sprintf("Rider%d", i), fmt.Sprintf("Driver%d", i)))
+	}
+	p.Resume()
+	p.Wait()
+
+	var late []string
+	for _, r := range p.SLAViolations(2500 * time.Millisecond) {
+		late = append(late, fmt.Sprintf("%s waited %v", r.Rider, r.Wait))
+	}
+	if want := []string{"Rider3 waited 3s", "Rider4 waited 4s"}; !slices.Equal(late, want) {
+		t.Errorf("SLAViolations(2.5s) = %v, want %v", late, want)
+	}
+	if v := p.SLAViolations(time.Hour); len(v) != 0 {
+		t.Errorf("SLAViolations(1h) = %v, want none", v)
+	}
+}
+
+func TestBuiltInStrategies(t *testing.T) {
+	rider := Rider{Name: "Alice", Location: Location{Lat: 40.0, Lng: -74.0}}
+	drivers := []Driver{
+		{Name: "Near", Location: Location{Lat: 40.01, Lng: -74.0}, Rating: 4.1, Weight: 1},
+		{Name: "Far", Location: Location{Lat: 40.5, Lng: -74.0}, Rating: 4.9, Weight: 2},
+		{Name: "Mid", Location: Location{Lat: 40.1, Lng: -74.0}, Rating: 4.5, Weight: 1},
+	}
+	picks := func(s Strategy, n int) []string {
+		var names []string
+		for range n {
+			d, ok := s.Select(rider, drivers)
+			if !ok {
+				t.Fatalf("%T found no driver", s)
+			}
+			names = append(names, d.Name)
+		}
+		return names
+	}
+
+	for _, tc := range []struct {
+		strategy Strategy
+		want     []string
+	}{
+		{NearestStrategy{}, []string{"Near", "Near", "Near"}},
+		{HighestRatedStrategy{}, []string{"Far", "Far", "Far"}},
+		{&RoundRobinStrategy{}, []string{"Near", "Far", "Mid", "Near"}},
+		{NewWeightedRoundRobinStrategy(), []string{"Far", "Near", "Mid", "Far"}},
+	} {
+		if got := picks(tc.strategy, len(tc.want)); !slices.Equal(got, tc.want) {
+			t.Errorf("%T picked %v, want %v", tc.strategy, got, tc.want)
+		}
+	}
+
+	first := picks(NewRandomStrategy(7), 20)
+	if again := picks(NewRandomStrategy(7), 20); !slices.Equal(first, again) {
+		t.Errorf("random strategies with the same seed picked %v and %v", first, again)
+	}
+	slices.Sort(first)
+	if names := slices.Compact(first); len(names) != len(drivers) {
+		t.Errorf("20 random picks only chose %v, want every driver at some point", names)
+	}
+}
+
+func TestResetBetweenBatches(t *testing.T) {
+	started, release := make(chan string, 1), make(chan struct{})
+	blocking := blockingProcessor(started, release)
+	p := newTestPool(2, 10, processorFunc(func(ctx context.Context, logger *slog.Logger, task Task) (Result, error) {
+		if task.Rider == "Slow" {
+			return blocking.Process(ctx, logger, task)
+		}
+		return assign(ctx, logger, task)
+	}))
+	p.Dedupe = true
+	p.Start()
+	finish := func() {
+		for p.Progress() < 1 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	p.Submit(NewTask("Slow", "Driver0"))
+	p.Submit(NewTask("Rider1", "Driver1"))
+	<-started
+	if err := p.Reset(); !errors.Is(err, ErrPoolBusy) {
+		t.Errorf("Reset() mid-run = %v, want ErrPoolBusy", err)
+	}
+	close(release)
+	finish()
+	if n := len(p.Results()); n != 2 {
+		t.Fatalf("first batch produced %d results, want 2", n)
+	}
+
+	// The last task is counted a moment before its worker lets go of it
+	err := p.Reset()
+	for errors.Is(err, ErrPoolBusy) {
+		time.Sleep(time.Millisecond)
+		err = p.Reset()
+	}
+	if err != nil {
+		t.Fatalf("Reset() between batches = %v", err)
+	}
+	if m := p.Metrics(); len(p.Results()) != 0 || m.Submitted != 0 || m.Completed != 0 {
+		t.Errorf("after Reset: %d results and metrics %+v, want a clean slate", len(p.Results()), m)
+	}
+	// Dedupe keys were cleared too, so the same rider can ride again.
+	if err := p.Submit(NewTask("Rider1", "Driver2")); err != nil {
+		t.Errorf("Submit() of a first-batch rider after Reset = %v", err)
+	}
+	finish()
+	if results := p.Results(); len(results) != 1 || results[0].Driver != "Driver2" {
+		t.Errorf("second batch results = %v, want only its own", results)
+	}
+
+	p.Shutdown(true)
+	if err := p.Reset(); !errors.Is(err, ErrPoolClosed) {
+		t.Errorf("Reset() after Shutdown = %v, want ErrPoolClosed", err)
+	}
+}
+
+func TestMetadataSurvivesEndToEnd(t *testing.T) {
+	var buf bytes.Buffer
+	var seen atomic.Value
+	p := NewWorkerPoolWithProcessor(context.Background(), 1, 10, slog.New(slog.NewJSONHandler(&buf, nil)),
+		processorFunc(func(ctx context.Context, logger *slog.Logger, task Task) (Result, error) {
+			seen.Store(task.Metadata["promo"])
+			return assign(ctx, logger, task)
+		}))
+	p.Start()
+	meta := map[string]string{"promo": "SPRING", "region": "east"}
+	task := NewTask("Rider1", "Driver1")
+	task.Metadata = meta
+	p.Submit(task)
+	meta["promo"] = "CHANGED" // Submit copied the map, so the task keeps SPRING
+	meta["extra"] = "late"
+	results, _ := p.Wait()
+
+	if got := seen.Load(); got != "SPRING" {
+		t.Errorf("processor saw promo %v, want SPRING", got)
+	}
+	if len(results) != 1 || !maps.Equal(results[0].Metadata, map[string]string{"promo": "SPRING", "region": "east"}) {
+		t.Fatalf("results = %v, want the metadata as submitted", results)
+	}
+	results[0].Metadata["promo"] = "MINE"
+	if again := p.Results(); again[0].Metadata["promo"] != "SPRING" {
+		t.Errorf("changing a returned result's metadata changed the pool's copy to %v", again[0].Metadata)
+	}
+
+	var found bool
+	for line := range strings.Lines(buf.String()) {
+		var record struct {
+			Msg      string            `json:"msg"`
+			Metadata map[string]string `json:"metadata"`
+		}
+		json.Unmarshal([]byte(line), &record)
+		if record.Msg == "finished task" {
+			found = true
+			if record.Metadata["promo"] != "SPRING" || record.Metadata["region"] != "east" {
+				t.Errorf("log record metadata = %v, want promo and region", record.Metadata)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("no finished task record in the logs:\n%s", buf.String())
+	}
+
+	var out bytes.Buffer
+	if err := p.WriteResultsJSON(&out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), `"promo": "SPRING"`) {
+		t.Errorf("JSON results lack the metadata:\n%s", out.String())
+	}
+}
+
+func TestMaxQueueWaitEvictsStaleTasks(t *testing.T) {
+	started, release := make(chan string, 10), make(chan struct{})
+	clock := NewFakeClock(time.Now())
+	p := newTestPool(1, 10, blockingProcessor(started, release))
+	p.Clock = clock
+	p.MaxQueueWait = time.Minute
+	p.Start()
+	p.Submit(NewTask("Stalled", "Driver0"))
+	<-started // The only worker is stuck, so the queue backs up
+	var stale []string
+	for i := range 3 {
+		task := NewTask(fmt.Sprintf("Stale%d", i), fmt.Sprintf("Driver%d", i+1))
+		stale = append(stale, task.ID)
+		p.Submit(task)
+	}
+	clock.Advance(2 * time.Minute)
+	p.Submit(NewTask("Fresh", "Driver9"))
+	close(release)
+	results, _ := p.Wait()
+
+	var done []string
+	for _, r := range results {
+		done = append(done, r.Rider)
+	}
+	slices.Sort(done)
+	if !slices.Equal(done, []string{"Fresh", "Stalled"}) {
+		t.Errorf("completed %v, want only the stalled task and the fresh one", done)
+	}
+	var expired []string
+	for _, task := range p.Expired() {
+		expired = append(expired, task.ID)
+	}
+	if !slices.Equal(expired, stale) {
+		t.Errorf("expired %v, want the stale tasks %v", expired, stale)
+	}
+	close(started)
+	for id := range started {
+		if slices.Contains(stale, id) {
+			t.Errorf("stale task %s was processed", id)
+		}
+	}
+}
+
+func TestMaxQueueWaitCountsFromLastQueued(t *testing.T) {
+	// The first attempt takes longer than MaxQueueWait, which must not
+	// count against the retry, whichever queue it goes back into.
+	for _, lane := range []int{0, 5} {
+		t.Run(fmt.Sprintf("RetryQueueSize=%d", lane), func(t *testing.T) {
+			clock := NewFakeClock(time.Now())
+			p := newTestPool(1, 10, processorFunc(func(ctx context.Context, logger *slog.Logger, task Task) (Result, error) {
+				if task.Retries == 0 {
+					clock.Advance(60 * time.Millisecond)
+					return Result{}, errNoShow
+				}
+				return assign(ctx, logger, task)
+			}))
+			p.Clock = clock
+			p.MaxQueueWait = 50 * time.Millisecond
+			p.MaxRetries = 1
+			p.RetryQueueSize = lane
+			p.Start()
+			p.Submit(NewTask("Rider1", "Driver1"))
+			results, _ := p.Wait()
+
+			if len(results) != 1 || len(p.Expired()) != 0 {
+				t.Errorf("%d results and %d expired, want the retry to run", len(results), len(p.Expired()))
+			}
+		})
+	}
+
+	// Time spent in a backend, before the pump moves a task into the
+	// buffer, is time spent queueing too
+	t.Run("backend", func(t *testing.T) {
+		clock := NewFakeClock(time.Now())
+		p := NewWorkerPool(WithWorkers(1), WithBuffer(1), WithLogger(DiscardLogger()), WithClock(clock),
+			WithProcessor(processorFunc(assign)), WithQueue(NewChannelQueue(10)))
+		p.MaxQueueWait = 30 * time.Millisecond
+		p.Start()
+		p.Pause()
+		for i := range 4 {
+			p.Submit(NewTask("Rider"+strconv.Itoa(i), "Driver"+strconv.Itoa(i)))
+		}
+		clock.Advance(100 * time.Millisecond)
+		p.Resume()
+		results, _ := p.Wait()
+
+		if len(results) != 0 || len(p.Expired()) != 4 {
+			t.Errorf("%d results and %d expired, want all 4 tasks expired", len(results), len(p.Expired()))
+		}
+	})
+}
+
+func TestWorkerIDsNeverReused(t *testing.T) {
+	p := newTestPool(3, 10, processorFunc(assign))
+	p.Start()
+	defer p.Shutdown(true)
+
+	seen := make(map[int]bool)
+	check := func(step string, want []int) {
+		t.Helper()
+		ids := p.WorkerIDs()
+		if !slices.Equal(ids, want) {
+			t.Errorf("after %s: WorkerIDs() = %v, want %v", step, ids, want)
+		}
+		for _, id := range ids {
+			if !slices.Contains(want, id) {
+				continue
+			}
+			seen[id] = true
+		}
+	}
+	fresh := func(step string, ids ...int) {
+		t.Helper()
+		for _, id := range ids {
+			if seen[id] {
+				t.Errorf("after %s: worker ID %d was reused", step, id)
+			}
+		}
+	}
+
+	check("Start", []int{1, 2, 3})
+	p.AddWorkers(2)
+	check("AddWorkers(2)", []int{1, 2, 3, 4, 5})
+	p.RemoveWorkers(2)
+	check("RemoveWorkers(2)", []int{1, 2, 3})
+	fresh("AddWorkers(1)", 6)
+	p.AddWorkers(1)
+	check("AddWorkers(1)", []int{1, 2, 3, 6})
+	fresh("Restart(2)", 7, 8)
+	p.Restart(2)
+	check("Restart(2)", []int{7, 8})
+	if err := p.Reset(); err != nil {
+		t.Fatalf("Reset() = %v", err)
+	}
+	fresh("Reset and AddWorkers(1)", 9)
+	p.AddWorkers(1)
+	check("Reset and AddWorkers(1)", []int{7, 8, 9})
+
+	// Tasks still run on the surviving workers, under their own IDs
+	for i := range 6 {
+		p.Submit(NewTask(fmt.Sprintf("Rider%d", i), fmt.Sprintf("Driver%d", i)))
+	}
+	for p.Progress() < 1 {
+		time.Sleep(time.Millisecond)
+	}
+	for _, r := range p.Results() {
+		if !slices.Contains([]int{7, 8, 9}, r.WorkerID) {
+			t.Errorf("%s ran on worker %d, want one of the running workers", r.Rider, r.WorkerID)
+		}
+	}
+}
+
+func TestSortedResultsFollowSubmissionOrder(t *testing.T) {
+	// Earlier tasks take longer, so they finish last
+	p := newTestPool(4, 10, processorFunc(func(ctx context.Context, logger *slog.Logger, task Task) (Result, error) {
+		n, _ := strconv.Atoi(strings.TrimPrefix(task.Rider, "Rider"))
+		time.Sleep(time.Duration(4-n) * 10 * time.Millisecond)
+		return assign(ctx, logger, task)
+	}))
+	p.Start()
+	want := []string{"Rider0", "Rider1", "Rider2", "Rider3"}
+	for _, rider := range want {
+		p.Submit(NewTask(rider, "Driver"+rider))
+	}
+	p.Wait()
+
+	var finished, sorted []string
+	for _, r := range p.Results() {
+		finished = append(finished, r.Rider)
+	}
+	for _, r := range p.SortedResults() {
+		sorted = append(sorted, r.Rider)
+	}
+	if !slices.Equal(sorted, want) {
+		t.Errorf("SortedResults() riders = %v, want submission order %v (finished in order %v)", sorted, want, finished)
+	}
+	if slices.Equal(finished, want) {
+		t.Errorf("Results() already in submission order %v, so nothing was sorted", finished)
+	}
+}
+
+func TestETAUsesHaversineDistance(t *testing.T) {
+	london, paris := Location{Lat: 51.5074, Lng: -0.1278}, Location{Lat: 48.8566, Lng: 2.3522}
+	if km := haversineKm(london, paris); math.Abs(km-343.5) > 1 {
+		t.Errorf("haversineKm(London, Paris) = %.1f km, want about 343.5", km)
+	}
+	if km := haversineKm(london, london); km != 0 {
+		t.Errorf("haversineKm(London, London) = %v km, want 0", km)
+	}
+
+	task := NewTask("Rider1", "Driver1")
+	task.RiderLat, task.RiderLng = london.Lat, london.Lng
+	task.DriverLat, task.DriverLng = paris.Lat, paris.Lng
+	want := time.Duration(343.5 / averageSpeedKmh * float64(time.Hour))
+	if eta := task.ETA(); eta < want-2*time.Minute || eta > want+2*time.Minute {
+		t.Errorf("ETA() from Paris to London = %v, want about %v at %v km/h", eta, want, averageSpeedKmh)
+	}
+}
+
+func TestPanicsRecordsRecoveredPanics(t *testing.T) {
+	p := newTestPool(1, 10, processorFunc(func(ctx context.Context, logger *slog.Logger, task Task) (Result, error) {
+		if task.Rider == "Bomb" {
+			panic("boom")
+		}
+		return assign(ctx, logger, task)
+	}))
+	p.Start()
+	bomb := NewTask("Bomb", "Driver1")
+	p.Submit(bomb)
+	p.Submit(NewTask("Rider1", "Driver2"))
+	p.Wait()
+
+	panics := p.Panics()
+	if len(panics) != 1 {
+		t.Fatalf("Panics() = %v, want one record", panics)
+	}
+	rec := panics[0]
+	if rec.TaskID != bomb.ID || rec.Value != "boom" || rec.WorkerID != 1 {
+		t.Errorf("Panics()[0] = {TaskID:%s Value:%v WorkerID:%d}, want {%s boom 1}", rec.TaskID, rec.Value, rec.WorkerID, bomb.ID)
+	}
+	if !strings.Contains(rec.Stack, "panic") {
+		t.Errorf("Panics()[0].Stack = %q, want the goroutine stack", rec.Stack)
+	}
+
+	panics[0].TaskID = "changed"
+	if p.Panics()[0].TaskID != bomb.ID {
+		t.Error("changing the slice Panics returned changed the pool's records")
+	}
+}
+
+func TestMetricsHandlerExposesPrometheusText(t *testing.T) {
+	p := newTestPool(1, 10, processorFunc(func(ctx context.Context, logger *slog.Logger, task Task) (Result, error) {
+		if task.Rider == "NoShow" {
+			return Result{}, errNoShow
+		}
+		return assign(ctx, logger, task)
+	}))
+	p.Start()
+	p.Submit(NewTask("Rider1", "Driver1"))
+	p.Submit(NewTask("Rider2", "Driver2"))
+	p.Submit(NewTask("NoShow", "Driver3"))
+	p.Wait()
+
+	srv := httptest.NewServer(p.MetricsHandler())
+	defer srv.Close()
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var body bytes.Buffer
+	body.ReadFrom(resp.Body)
+
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %q, want the Prometheus text format", ct)
+	}
+	for _, want := range []string{
+		"# TYPE tasks_processed_total counter\ntasks_processed_total 2\n",
+		"# TYPE tasks_failed_total counter\ntasks_failed_total 1\n",
+		"# TYPE tasks_in_flight gauge\ntasks_in_flight 0\n",
+		"# TYPE task_duration_seconds summary\n",
+		`task_duration_seconds{quantile="0.5"} `,
+		`task_duration_seconds{quantile="0.95"} `,
+		`task_duration_seconds{quantile="0.99"} `,
+	} {
+		if !strings.Contains(body.String(), want) {
+			t.Errorf("scrape is missing %q:\n%s", want, body.String())
+		}
+	}
+}
+
+func TestErrorsDeliversFailuresThenCloses(t *testing.T) {
+	p := newTestPool(2, 10, processorFunc(func(ctx context.Context, logger *slog.Logger, task Task) (Result, error) {
+		if strings.HasPrefix(task.Rider, "NoShow") {
+			return Result{}, errNoShow
+		}
+		return assign(ctx, logger, task)
+	}))
+	errs := p.Errors()
+	p.Start()
+	for _, rider := range []string{"NoShow1", "Rider1", "NoShow2", "NoShow3"} {
+		p.Submit(NewTask(rider, "Driver"+rider))
+	}
+
+	// Nobody reads until the pool is done; the workers must not block on it
+	done := make(chan struct{})
+	go func() {
+		p.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Wait blocked while nobody read the Errors channel")
+	}
+
+	var riders []string
+	timeout := time.After(time.Second)
+	for open := true; open; {
+		select {
+		case te, ok := <-errs:
+			if !ok {
+				open = false
+				break
+			}
+			if !errors.Is(te.Err, errNoShow) {
+				t.Errorf("error for %s = %v, want errNoShow", te.Task.Rider, te.Err)
+			}
+			riders = append(riders, te.Task.Rider)
+		case <-timeout:
+			t.Fatalf("Errors channel not closed after Shutdown; received %v", riders)
+		}
+	}
+	slices.Sort(riders)
+	if !slices.Equal(riders, []string{"NoShow1", "NoShow2", "NoShow3"}) {
+		t.Errorf("Errors delivered %v, want NoShow1-3", riders)
+	}
+
+	if _, ok := <-p.Errors(); ok {
+		t.Error("Errors() after shutdown delivered a value, want a closed channel")
+	}
+}
+
+func TestEventsRecordTaskLifecycle(t *testing.T) {
+	p := newTestPool(1, 10, processorFunc(func(ctx context.Context, logger *slog.Logger, task Task) (Result, error) {
+		if task.Rider == "NoShow" {
+			return Result{}, errNoShow
+		}
+		return assign(ctx, logger, task)
+	}))
+	p.Start()
+	ok, noShow := NewTask("Rider1", "Driver1"), NewTask("NoShow", "Driver2")
+	p.Submit(ok)
+	p.Submit(noShow)
+	p.Wait()
+
+	byTask := make(map[string][]EventType)
+	var last Event
+	shutdowns := 0
+	for i, e := range p.Events() {
+		if i > 0 && e.Time.Before(last.Time) {
+			t.Errorf("event %d (%s) at %v is earlier than the one before it", i, e.Type, e.Time)
+		}
+		last = e
+		if e.Type == EventShutdown {
+			shutdowns++
+		} else {
+			byTask[e.TaskID] = append(byTask[e.TaskID], e.Type)
+		}
+		if e.Type == EventFail && !errors.Is(e.Err, errNoShow) {
+			t.Errorf("fail event error = %v, want errNoShow", e.Err)
+		}
+	}
+	if got, want := byTask[ok.ID], []EventType{EventSubmit, EventStart, EventComplete}; !slices.Equal(got, want) {
+		t.Errorf("events for the assigned task = %v, want %v", got, want)
+	}
+	if got, want := byTask[noShow.ID], []EventType{EventSubmit, EventStart, EventFail}; !slices.Equal(got, want) {
+		t.Errorf("events for the failed task = %v, want %v", got, want)
+	}
+	if shutdowns != 1 {
+		t.Errorf("%d shutdown events, want one from Wait", shutdowns)
+	}
+}
+
+func TestAgingStartsWhenScheduledTaskIsDue(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	p := newTestPool(1, 10, processorFunc(assign))
+	p.Clock = clock
+	p.AgingRate = 1
+	p.Start()
+	p.Pause()
+	later := NewTask("Later", "Driver1")
+	later.StartAfter = clock.Now().Add(time.Hour)
+	p.Submit(later)
+	clock.Advance(time.Hour)
+	urgent := NewTask("Urgent", "Driver2")
+	urgent.Priority = 1000
+	p.Submit(urgent)
+	p.Resume()
+	results, _ := p.Wait()
+
+	// Both have only just become ready, so Urgent's priority decides; the
+	// hour Later was held back must not count as time spent waiting.
+	var riders []string
+	for _, r := range results {
+		riders = append(riders, r.Rider)
+	}
+	if !slices.Equal(riders, []string{"Urgent", "Later"}) {
+		t.Errorf("completion order %v, want Urgent before Later", riders)
+	}
+}
+
+func TestMainStdinExitsOnInterrupt(t *testing.T) {
+	// main installs signal handlers and reads the real stdin, so run it in
+	// a child copy of the test binary whose stdin stays open, as it would at
+	// an interactive prompt.
+	if os.Getenv("MAIN_STDIN_CHILD") == "1" {
+		os.Args = []string{os.Args[0], "-stdin", "-workers", "1", "-drain-timeout", "5s"}
+		main()
+		return
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestMainStdinExitsOnInterrupt$")
+	cmd.Env = append(os.Environ(), "MAIN_STDIN_CHILD=1")
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdin.Close()
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintln(stdin, `{"rider":"Alice","driver":"Bob"}`)
+
+	// Once the task is running, main is past installing its signal handler
+	running := make(chan struct{})
+	go func() {
+		ready, lines := running, bufio.NewScanner(stderr)
+		for lines.Scan() { // Keep draining so the child never blocks on a write
+			if ready != nil && strings.Contains(lines.Text(), "processing task") {
+				close(ready)
+				ready = nil
+			}
+		}
+	}()
+	select {
+	case <-running:
+	case <-time.After(5 * time.Second):
+		cmd.Process.Kill()
+		t.Fatal("child never started the task")
+	}
+	cmd.Process.Signal(os.Interrupt)
+
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	select {
+	case err := <-exited:
+		if err != nil {
+			t.Errorf("child exited with %v, want a clean exit after the drain", err)
+		}
+	case <-time.After(5 * time.Second):
+		cmd.Process.Kill()
+		<-exited
+		t.Fatal("child still blocked reading stdin after Ctrl-C")
+	}
+	if out := stdout.String(); !strings.Contains(out, "Assigned Bob to Alice") || !strings.Contains(out, "Run summary:") {
+		t.Errorf("child output lacks the assignment or the summary:\n%s", out)
+	}
+}